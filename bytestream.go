@@ -0,0 +1,58 @@
+package opusreader
+
+import (
+	"errors"
+	"io"
+)
+
+// In-memory stream which hands out slices of its buffer instead of copying
+type byteStream struct {
+	data   []byte
+	offset int64
+}
+
+func (s *byteStream) Read(p []byte) (int, error) {
+	if s.offset >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[s.offset:])
+	s.offset += int64(n)
+	return n, nil
+}
+
+func (s *byteStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += int64(len(s.data))
+	default:
+		return 0, errors.New("bytestream: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("bytestream: negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+// next returns the next n bytes of the buffer, capped so appending to the
+// result doesn't modify the buffer
+func (s *byteStream) next(n int) ([]byte, error) {
+	if n == 0 {
+		// e.g. the body of a page without segments at the end of the buffer
+		return []byte{}, nil
+	}
+	if s.offset >= int64(len(s.data)) {
+		return nil, io.EOF
+	}
+	end := s.offset + int64(n)
+	if end > int64(len(s.data)) {
+		s.offset = int64(len(s.data))
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := s.data[s.offset:end:end]
+	s.offset = end
+	return data, nil
+}
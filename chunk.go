@@ -0,0 +1,65 @@
+package opusreader
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Size of the length prefix of packets packed by ReadChunk
+const chunkLengthSize = 4
+
+// ReadChunk fills buf with as many whole audio packets as fit, each prefixed
+// with its length as a 4 bytes big-endian integer, and returns the number of
+// bytes and packets written. Packets are never split, one which doesn't fit
+// is returned by the next call. It returns io.EOF when there are no packets
+// left.
+func (o *OPUSReader) ReadChunk(buf []byte) (n int, packets int, err error) {
+	for o.pending != nil || !o.LastPacket {
+		packet, err := o.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, packets, err
+		}
+
+		size := chunkLengthSize + len(packet.PacketData)
+		if n+size > len(buf) {
+			o.unreadPacket(packet)
+			if packets == 0 {
+				return 0, 0, errors.New("opusreader: packet doesn't fit in chunk")
+			}
+			return n, packets, nil
+		}
+
+		binary.BigEndian.PutUint32(buf[n:], uint32(len(packet.PacketData)))
+		copy(buf[n+chunkLengthSize:], packet.PacketData)
+		n += size
+		packets++
+	}
+
+	if packets == 0 {
+		return 0, 0, io.EOF
+	}
+	return n, packets, nil
+}
+
+// WriteDelimited writes the remaining audio packets to w, each prefixed with
+// its length as a 2 bytes big-endian integer, the FramingUint16 framing read
+// by NewRawOpusReader
+func (o *OPUSReader) WriteDelimited(w io.Writer) error {
+	prefix := make([]byte, 2)
+	return o.eachPacket(func(packet *OPUSPacket) error {
+		if len(packet.PacketData) > math.MaxUint16 {
+			return errors.New("opusreader: packet too large for 16 bits length")
+		}
+		binary.BigEndian.PutUint16(prefix, uint16(len(packet.PacketData)))
+		if _, err := w.Write(prefix); err != nil {
+			return err
+		}
+		_, err := w.Write(packet.PacketData)
+		return err
+	})
+}
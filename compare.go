@@ -0,0 +1,42 @@
+package opusreader
+
+import (
+	"bytes"
+	"io"
+)
+
+// AudioEqual reads the rest of both streams and reports whether they carry
+// the same audio packets, compared byte for byte, regardless of the headers,
+// the comments and the pagination. The reading stops at the first
+// difference.
+func AudioEqual(a, b *OPUSReader) (bool, error) {
+	for {
+		packetA, err := a.nextAudioPacket()
+		if err != nil {
+			return false, err
+		}
+		packetB, err := b.nextAudioPacket()
+		if err != nil {
+			return false, err
+		}
+		if packetA == nil || packetB == nil {
+			return packetA == nil && packetB == nil, nil
+		}
+		if !bytes.Equal(packetA.PacketData, packetB.PacketData) {
+			return false, nil
+		}
+	}
+}
+
+// nextAudioPacket returns the next audio packet, or nil at the end of the
+// stream
+func (o *OPUSReader) nextAudioPacket() (*OPUSPacket, error) {
+	if o.pending == nil && o.LastPacket {
+		return nil, nil
+	}
+	packet, err := o.NextPacket()
+	if err == io.EOF {
+		return nil, nil
+	}
+	return packet, err
+}
@@ -0,0 +1,50 @@
+package opusreader
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTimeout is matched by errors.Is for the errors returned when reading the
+// stream failed because a read deadline was exceeded
+var ErrTimeout = errors.New("opusreader: read timeout")
+
+// Streams with read deadlines, like net.Conn
+type deadlineReader interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return ErrTimeout.Error() + ": " + e.err.Error()
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// isTimeout reports whether the error of a read is a deadline being exceeded
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// setReadDeadline sets the deadline of the next packet read if the reader has
+// a ReadTimeout and the stream supports deadlines
+func (o *OPUSReader) setReadDeadline() error {
+	if o.ReadTimeout <= 0 {
+		return nil
+	}
+	stream, ok := o.OGGReader.stream.(deadlineReader)
+	if !ok {
+		return nil
+	}
+	return stream.SetReadDeadline(time.Now().Add(o.ReadTimeout))
+}
@@ -0,0 +1,84 @@
+package opusreader
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Decoder decodes opus packets to PCM, e.g. a binding of libopus. The package
+// only parses the container, so the decoding is left to the caller.
+type Decoder interface {
+	// Decode decodes the packet into pcm as interleaved float samples
+	// nominally in [-1, 1] and returns the number of samples per channel
+	Decode(packet []byte, pcm []float32) (int, error)
+}
+
+// DecodeAll decodes the rest of the stream with dec and calls fn with the
+// interleaved samples of each packet, with the pre-skip trimmed and the
+// playback gain applied. The gain is the OutputGain of the header plus the
+// R128_TRACK_GAIN tag if the stream has a valid one, as applied by players
+// normalizing the loudness. The samples pushed out of [-1, 1] by the gain
+// are counted in ClippedSampleCount, they are passed to fn unclipped.
+func (o *OPUSReader) DecodeAll(dec Decoder, fn func(pcm []float32) error) error {
+	if dec == nil {
+		return errors.New("opusreader: decoder is nil")
+	}
+	if err := o.ensureHeaders(); err != nil {
+		return err
+	}
+
+	channels := int(o.ChannelCount)
+	gain := float32(o.playbackGainFactor())
+	pcm := make([]float32, maxPacketSamples*channels)
+	return o.eachPacket(func(packet *OPUSPacket) error {
+		n, err := dec.Decode(packet.PacketData, pcm)
+		if err != nil {
+			return err
+		}
+		if n > maxPacketSamples {
+			return errors.New("opusreader: decoder returned too many samples")
+		}
+		// the pre-skip and the seek pre-roll are trimmed at the start
+		start := n - packet.TotalSamples
+		if start < 0 {
+			start = 0
+		}
+		samples := pcm[start*channels : n*channels]
+		for i := range samples {
+			samples[i] *= gain
+			if samples[i] > 1 || samples[i] < -1 {
+				o.ClippedSampleCount++
+			}
+		}
+		if fn == nil {
+			return nil
+		}
+		return fn(samples)
+	})
+}
+
+// playbackGainFactor returns the linear factor of the output gain and the
+// track gain tag applied on playback
+func (o *OPUSReader) playbackGainFactor() float64 {
+	gainDB := float64(int16(o.OutputGain)) / 256.0
+	if trackGain, ok := o.trackGain(); ok {
+		gainDB += trackGain
+	}
+	return math.Pow(10, gainDB/20)
+}
+
+// trackGain returns the R128_TRACK_GAIN tag in dB, which is stored as a Q7.8
+// integer bringing the output to the reference level
+// https://tools.ietf.org/html/rfc7845#section-5.2.1
+func (o *OPUSReader) trackGain() (float64, bool) {
+	values := commentsMap(o.Comments)["R128_TRACK_GAIN"]
+	if len(values) == 0 {
+		return 0, false
+	}
+	gain, err := strconv.ParseInt(values[0], 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return float64(gain) / 256, true
+}
@@ -0,0 +1,307 @@
+package opusreader
+
+import (
+	"errors"
+	"time"
+)
+
+// Maximum size of a single opus frame
+// https://tools.ietf.org/html/rfc6716#section-3.4
+const maxFrameSize = 1275
+
+// Limits of a single opus packet: at most 120ms of audio, i.e. 5760 samples
+// at 48000 Hz, in at most 48 frames of 2.5ms
+// https://tools.ietf.org/html/rfc6716#section-3.2.5
+const (
+	maxPacketSamples = 5760
+	maxPacketFrames  = 48
+)
+
+// ReadOpusFrameLength decodes a frame length coded in one byte for lengths
+// below 252, or in two bytes otherwise, and returns it with the number of
+// bytes consumed
+// https://tools.ietf.org/html/rfc6716#section-3.2.1
+func ReadOpusFrameLength(data []byte) (length, bytesConsumed int, err error) {
+	if len(data) < 1 {
+		return 0, 0, errors.New("opusreader: missing frame length")
+	}
+	if data[0] < 252 {
+		return int(data[0]), 1, nil
+	}
+	if len(data) < 2 {
+		return 0, 0, errors.New("opusreader: truncated frame length")
+	}
+	return 4*int(data[1]) + int(data[0]), 2, nil
+}
+
+// Splits the packet into frames according to the frame count code of the
+// TOC byte and returns them with the padding of code 3 packets
+// https://tools.ietf.org/html/rfc6716#section-3.2
+func parseFrames(packet []byte) ([][]byte, []byte, error) {
+	if len(packet) < 1 {
+		return nil, nil, errors.New("opusreader: invalid TOC byte")
+	}
+	data := packet[1:]
+
+	var frames [][]byte
+	var padding []byte
+	switch packet[0] & 3 {
+	case 0:
+		frames = [][]byte{data}
+	case 1:
+		if len(data)%2 != 0 {
+			return nil, nil, errors.New("opusreader: odd size of code 1 packet")
+		}
+		frames = [][]byte{data[:len(data)/2], data[len(data)/2:]}
+	case 2:
+		size, n, err := ReadOpusFrameLength(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = data[n:]
+		if size > len(data) {
+			return nil, nil, errors.New("opusreader: frame length exceeds packet size")
+		}
+		frames = [][]byte{data[:size], data[size:]}
+	case 3:
+		if len(data) < 1 {
+			return nil, nil, errors.New("opusreader: missing frame count byte")
+		}
+		vbr := data[0]&0x80 != 0
+		hasPadding := data[0]&0x40 != 0
+		count := int(data[0] & 0x3F)
+		data = data[1:]
+		if count == 0 {
+			return nil, nil, errors.New("opusreader: zero frames in code 3 packet")
+		}
+
+		if hasPadding {
+			paddingSize := 0
+			for {
+				if len(data) < 1 {
+					return nil, nil, errors.New("opusreader: truncated padding length")
+				}
+				b := data[0]
+				data = data[1:]
+				if b < 255 {
+					paddingSize += int(b)
+					break
+				}
+				paddingSize += 254
+			}
+			if paddingSize > len(data) {
+				return nil, nil, errors.New("opusreader: padding exceeds packet size")
+			}
+			padding = data[len(data)-paddingSize:]
+			data = data[:len(data)-paddingSize]
+		}
+
+		if vbr {
+			sizes := make([]int, count-1)
+			for i := range sizes {
+				size, n, err := ReadOpusFrameLength(data)
+				if err != nil {
+					return nil, nil, err
+				}
+				sizes[i] = size
+				data = data[n:]
+			}
+			for _, size := range sizes {
+				if size > len(data) {
+					return nil, nil, errors.New("opusreader: frame length exceeds packet size")
+				}
+				frames = append(frames, data[:size])
+				data = data[size:]
+			}
+			frames = append(frames, data)
+		} else {
+			if len(data)%count != 0 {
+				return nil, nil, errors.New("opusreader: size of code 3 CBR packet is not a multiple of frame count")
+			}
+			size := len(data) / count
+			for i := 0; i < count; i++ {
+				frames = append(frames, data[i*size:(i+1)*size])
+			}
+		}
+	}
+
+	for _, frame := range frames {
+		if len(frame) > maxFrameSize {
+			return nil, nil, errors.New("opusreader: frame exceeds maximum size")
+		}
+	}
+
+	return frames, padding, nil
+}
+
+// Padding returns the padding bytes of a code 3 packet, which may carry
+// extension data, or nil if the packet has no padding
+func (p *OPUSPacket) Padding() []byte {
+	if len(p.padding) == 0 {
+		return nil
+	}
+	return p.padding
+}
+
+// Extension carried in the padding of an opus packet
+type OpusExtension struct {
+	// Extension ID from 2 to 127, IDs below 32 have at most 1 byte of data
+	ID uint8
+	// Index of the frame of the packet the extension belongs to
+	Frame int
+	Data  []byte
+}
+
+// ID of the Deep REDundancy extension, in the experimental range, as used by
+// libopus
+const ExtensionIDDRED = 126
+
+// Extensions parses the padding of a code 3 packet as a sequence of
+// extensions. Each starts with a byte holding the ID in the upper 7 bits and
+// the L flag in the lowest one. ID 0 is padding: one byte if L is set,
+// otherwise the rest of the data, so zero filled padding holds no extensions.
+// ID 1 separates the extensions of consecutive frames. IDs 2 to 31 have no
+// data, or 1 byte if L is set. Larger IDs take the rest of the data, or if L
+// is set a length coded like the padding length followed by the data.
+// https://datatracker.ietf.org/doc/draft-ietf-mlcodec-opus-extension/
+func (p *OPUSPacket) Extensions() ([]OpusExtension, error) {
+	data := p.padding
+	frames := p.FramesNumber
+	if frames == 0 {
+		frames = 1
+	}
+
+	var extensions []OpusExtension
+	frame := 0
+	for len(data) > 0 {
+		id := data[0] >> 1
+		long := data[0]&1 != 0
+		data = data[1:]
+		switch {
+		case id == 0 && long:
+			continue
+		case id == 0:
+			return extensions, nil
+		case id == 1:
+			step := 1
+			if long {
+				if len(data) < 1 {
+					return nil, errors.New("opusreader: truncated frame separator")
+				}
+				step = int(data[0])
+				data = data[1:]
+			}
+			frame += step
+			if frame >= frames {
+				return nil, errors.New("opusreader: extension frame exceeds frame count")
+			}
+			continue
+		}
+
+		var payload []byte
+		switch {
+		case id < 32:
+			if long {
+				if len(data) < 1 {
+					return nil, errors.New("opusreader: truncated extension")
+				}
+				payload = data[:1]
+				data = data[1:]
+			}
+		case !long:
+			payload = data
+			data = nil
+		default:
+			size := 0
+			for {
+				if len(data) < 1 {
+					return nil, errors.New("opusreader: truncated extension length")
+				}
+				b := data[0]
+				data = data[1:]
+				size += int(b)
+				if b < 255 {
+					break
+				}
+			}
+			if size > len(data) {
+				return nil, errors.New("opusreader: extension length exceeds padding size")
+			}
+			payload = data[:size]
+			data = data[size:]
+		}
+		extensions = append(extensions, OpusExtension{ID: id, Frame: frame, Data: payload})
+	}
+	return extensions, nil
+}
+
+// Single frame of an opus packet with its duration
+type OpusFrame struct {
+	Data     []byte
+	Duration time.Duration
+}
+
+// FramesWithDuration splits the packet into its frames. All the frames of
+// a packet share the config of the TOC byte, so they have the same duration.
+// Empty frames are DTX or lost frames which still have the duration. Packets
+// of multistream streams can't be split this way.
+func (p *OPUSPacket) FramesWithDuration() ([]OpusFrame, error) {
+	frames, _, err := parseFrames(p.PacketData)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := samplesToDuration(int64(getSamplesPerFrame(p.PacketData)))
+	result := make([]OpusFrame, len(frames))
+	for i, frame := range frames {
+		result[i] = OpusFrame{Data: frame, Duration: duration}
+	}
+	return result, nil
+}
+
+// HasFEC reports whether any frame of a SILK or hybrid packet carries LBRR
+// data, the in-band forward error correction of the previous frame. The LBRR
+// flags are read from the header bits which start the SILK layer of each
+// frame: the VAD flag of each SILK frame followed by the LBRR flag, for the
+// mid and then the side channel of stereo frames. They are coded with
+// a probability of one half, so they are the leading bits of the frame.
+// CELT packets never carry FEC, nor do empty frames. Packets of multistream
+// streams aren't inspected.
+// https://tools.ietf.org/html/rfc6716#section-4.2.3
+func (p *OPUSPacket) HasFEC() bool {
+	if p.multistream || len(p.PacketData) < 1 {
+		return false
+	}
+	config := p.PacketData[0] >> 3
+	if config >= 16 {
+		return false
+	}
+	frames, _, err := parseFrames(p.PacketData)
+	if err != nil {
+		return false
+	}
+
+	// SILK frames of 20ms in each opus frame, 10ms frames have one too
+	silkFrames := 1
+	if config < 12 {
+		switch config % 4 {
+		case 2:
+			silkFrames = 2
+		case 3:
+			silkFrames = 3
+		}
+	}
+	channels := 1 + int(p.PacketData[0]>>2&1)
+	for _, frame := range frames {
+		if len(frame) == 0 {
+			continue
+		}
+		for channel := 0; channel < channels; channel++ {
+			bit := channel*(silkFrames+1) + silkFrames
+			if frame[0]&(0x80>>uint(bit)) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
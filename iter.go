@@ -0,0 +1,29 @@
+//go:build go1.23
+
+package opusreader
+
+import (
+	"io"
+	"iter"
+)
+
+// Packets returns an iterator over the remaining audio packets, for use with
+// range. It stops at the end of the stream, any other error is yielded with
+// a nil packet as the last value.
+func (o *OPUSReader) Packets() iter.Seq2[*OPUSPacket, error] {
+	return func(yield func(*OPUSPacket, error) bool) {
+		for !o.LastPacket {
+			packet, err := o.NextPacket()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(packet, nil) {
+				return
+			}
+		}
+	}
+}
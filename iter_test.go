@@ -0,0 +1,39 @@
+//go:build go1.23
+
+package opusreader
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackets(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	count := 0
+	for packet, err := range NewOpusReaderBytes(data).Packets() {
+		if !assert.NoError(t, err) {
+			break
+		}
+		assert.Equal(t, count == 0, packet.IsFirstAudioPacket, "Wrong first audio packet")
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+
+	reader := NewOpusReaderBytes(data)
+	for range reader.Packets() {
+		break
+	}
+	assert.Equal(t, int64(960-312), reader.Position(), "Packets are read after break")
+
+	var last error
+	for _, err := range NewOpusReaderBytes(data[:1000]).Packets() {
+		last = err
+	}
+	assert.True(t, errors.Is(last, io.ErrUnexpectedEOF), "Wrong error %v", last)
+}
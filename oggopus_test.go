@@ -1,9 +1,18 @@
 package opusreader
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestIDHeader(t *testing.T) {
@@ -30,3 +39,2851 @@ func TestIDHeader(t *testing.T) {
 	assert.Equal(t, uint32(48000), reader.InputSampleRate, "Wrong sample rates")
 	assert.Equal(t, uint8(1), reader.Version, "Wrong version")
 }
+
+func TestFirstAudioPacket(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	count := 0
+	for !reader.LastPacket {
+		packet, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, count == 0, packet.IsFirstAudioPacket, "Wrong first audio packet flag")
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+}
+
+func TestPosition(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	assert.Equal(t, int64(0), reader.Position(), "Wrong position before reading")
+	count := 0
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		count++
+		if count == 1 {
+			assert.Equal(t, int64(960-312), reader.Position(), "Pre-skip isn't subtracted")
+		}
+	}
+	assert.Equal(t, int64(541*960-312), reader.Position(), "Wrong position at the end")
+}
+
+func TestTailPackets(t *testing.T) {
+	ogg, err := os.Open("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ogg.Close()
+
+	reader, err := NewOpusReader(ogg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total, err := reader.TotalDuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 10800*time.Millisecond, total, "Wrong total duration")
+
+	packets, err := reader.TailPackets(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, len(packets), "Wrong number of packets")
+	assert.Equal(t, true, reader.LastPacket, "Reader is not at the end")
+
+	err = reader.SeekEnd(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for !reader.LastPacket {
+		_, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.True(t, count >= 50, "Too few packets after SeekEnd")
+	assert.Equal(t, 10813500, reader.Duration, "Wrong duration after SeekEnd")
+}
+
+func TestResumeAfterPartialPage(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cut the stream in the middle of the third page's segment table
+	reader, err := NewOpusReader(bytes.NewReader(data[:137+27+50]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.NextPacket()
+	assert.Error(t, err, "Truncated stream is read")
+	assert.Equal(t, int64(137), reader.OGGReader.bytesReadSuccesfully, "Wrong resume offset")
+
+	reader.OGGReader.ResetReader(func(bytesRead int64) io.Reader {
+		return bytes.NewReader(data[bytesRead:])
+	})
+	count := 0
+	for !reader.LastPacket {
+		_, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets after resume")
+}
+
+func TestResumeAtPageBoundary(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cut int
+	for _, page := range splitPages(data)[:5] {
+		cut += len(page)
+	}
+
+	// the stream is cut after the fifth page, between two pages
+	reader, err := NewOpusReader(bytes.NewReader(data[:cut]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for !reader.EndOfStream() {
+		_, err := reader.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.Equal(t, 150, count, "Wrong number of packets before the cut")
+	assert.True(t, reader.EndOfStream(), "End of input is not reported")
+
+	reader.OGGReader.ResetReader(func(bytesRead int64) io.Reader {
+		return bytes.NewReader(data[bytesRead:])
+	})
+	for !reader.LastPacket {
+		_, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, reader.EndOfStream() && !reader.LastPacket, "End of input is kept after resume")
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets after resume")
+	assert.True(t, reader.EndOfStream(), "End of stream is not reported")
+}
+
+func TestExpectedGainFactor(t *testing.T) {
+	reader := &OPUSReader{}
+	assert.Equal(t, 1.0, reader.ExpectedGainFactor(), "Zero gain is not unity")
+
+	reader.OutputGain = 20 * 256
+	assert.InDelta(t, 10.0, reader.ExpectedGainFactor(), 1e-9, "Wrong factor for +20dB")
+
+	reader.OutputGain = uint16(0x10000 - 6*256)
+	assert.InDelta(t, 0.501187, reader.ExpectedGainFactor(), 1e-6, "Wrong factor for -6dB")
+}
+
+// splitPages splits a physical stream into raw pages
+func splitPages(data []byte) [][]byte {
+	var pages [][]byte
+	for len(data) >= 27 {
+		segments := int(data[26])
+		size := 27 + segments
+		for _, s := range data[27 : 27+segments] {
+			size += int(s)
+		}
+		pages = append(pages, data[:size])
+		data = data[size:]
+	}
+	return pages
+}
+
+func TestMultiTrack(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream []byte
+	for _, page := range splitPages(data) {
+		other := append([]byte(nil), page...)
+		binary.LittleEndian.PutUint32(other[14:18], 42)
+		stream = append(stream, page...)
+		stream = append(stream, other...)
+	}
+
+	reader, err := NewOpusReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.OGGReader.MultiTrack = true
+	second := reader.Track(42)
+
+	counts := []int{0, 0}
+	for i, track := range []*OPUSReader{reader, second, reader, second} {
+		for j := 0; j < 100 && !track.LastPacket; j++ {
+			_, err := track.NextPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[i%2]++
+		}
+	}
+	for !second.LastPacket {
+		if _, err := second.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		counts[1]++
+	}
+	assert.Equal(t, []int{200, 541}, counts, "Wrong number of packets per track")
+	assert.Equal(t, 10813500, second.Duration, "Wrong duration of the second track")
+}
+
+func TestMultiTrackSeek(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream []byte
+	for _, page := range splitPages(data) {
+		other := append([]byte(nil), page...)
+		binary.LittleEndian.PutUint32(other[14:18], 42)
+		stream = append(stream, page...)
+		stream = append(stream, other...)
+	}
+
+	reader, err := NewOpusReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.OGGReader.MultiTrack = true
+	second := reader.Track(42)
+
+	count := 0
+	for ; count < 10; count++ {
+		if _, err := second.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = second.TotalDuration()
+	assert.Error(t, err, "Track seeks the shared stream")
+	_, err = second.GranuleMonotonic()
+	assert.Error(t, err, "Track seeks the shared stream")
+	for !second.LastPacket {
+		if _, err := second.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets of the track")
+
+	// the pages queued for the first track are dropped by seeking
+	reader, err = NewOpusReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.OGGReader.MultiTrack = true
+	second = reader.Track(42)
+	if _, err := reader.NextPacket(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := second.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NoError(t, reader.SeekEnd(100*time.Millisecond))
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, packet.GranulePosition > 10*48000, "Queued page is returned after seeking")
+	}
+}
+
+func TestHeaderOnly(t *testing.T) {
+	ogg, err := os.Open("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ogg.Close()
+
+	reader, err := NewOggReader(ogg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.HeaderOnly = true
+
+	var granules []int64
+	for {
+		page, err := reader.NextPage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		granules = append(granules, page.AbsoluteGranulePosition)
+	}
+	assert.Equal(t, 13, len(granules), "Wrong number of pages")
+	assert.Equal(t, int64(518712), granules[12], "Wrong last granule")
+	assert.Equal(t, int64(240237), reader.bytesReadSuccesfully, "Wrong number of bytes")
+}
+
+func TestGranuleInterpolation(t *testing.T) {
+	ogg, err := os.Open("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ogg.Close()
+
+	reader, err := NewOpusReader(ogg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all the packets are 20ms long, the first 500 packets fill ten pages
+	// and the end-trimmed last page holds the rest
+	for i := 0; !reader.LastPacket; i++ {
+		packet, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := int64(960 * (i + 1))
+		if expected > 518712 {
+			expected = 518712
+		}
+		if !assert.Equal(t, expected, packet.GranulePosition, "Wrong granule of packet %d", i) {
+			break
+		}
+	}
+}
+
+func TestSkipTo(t *testing.T) {
+	ogg, err := os.Open("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ogg.Close()
+
+	reader, err := NewOpusReader(ogg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reader.SkipTo(96000 + 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(96000-312), reader.Position(), "Wrong position after SkipTo")
+	packet, err := reader.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(96960), packet.GranulePosition, "Wrong packet after SkipTo")
+	assert.Equal(t, (96960-312)*1000000/48000, reader.Duration, "Wrong duration after SkipTo")
+}
+
+func TestSeekAfterSkipTo(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	assert.NoError(t, reader.SkipTo(4800))
+	assert.NoError(t, reader.SeekEnd(100*time.Millisecond))
+	position := reader.Position()
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, packet.GranulePosition > 10*48000, "Packet put back before the seek is returned")
+		assert.Equal(t, position+int64(packet.TotalSamples), reader.Position(), "Wrong position")
+	}
+}
+
+func TestSkipToUnknownGranule(t *testing.T) {
+	packets := bytes.Repeat([]byte{0, 1, 0xf8}, 10)
+	reader, err := NewRawOpusReader(bytes.NewReader(packets), OPUSIDHeader{ChannelCount: 1}, FramingUint16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, reader.SkipTo(4800), "Unknown granule positions are skipped")
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, packet.IsFirstAudioPacket, "Packet is consumed")
+	}
+}
+
+func TestOpusReaderBytes(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := append([]byte(nil), data...)
+
+	reader := NewOpusReaderBytes(data)
+	count := 0
+	for !reader.LastPacket {
+		packet, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 0 {
+			assert.Equal(t, &data[137+27+120], &packet.PacketData[0], "Packet data is copied")
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+	assert.Equal(t, 10813500, reader.Duration, "Wrong duration")
+	assert.Equal(t, original, data, "Input data was modified")
+}
+
+func TestCopyPackets(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := append([]byte(nil), data...)
+
+	reader := NewOpusReaderBytes(data)
+	reader.CopyPackets = true
+	count := 0
+	for !reader.LastPacket {
+		packet, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range packet.PacketData {
+			packet.PacketData[i] = 0
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+	assert.Equal(t, original, data, "Copied packets share the input buffer")
+}
+
+func TestPacketFramesValidation(t *testing.T) {
+	// code 3 VBR packet of 6 frames with lengths for 4 frames only
+	packet := &OPUSPacket{PacketData: []byte{0xFB, 0x86, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1}}
+	assert.Error(t, packet.readPacketConfig(), "Truncated packet is accepted")
+
+	packet = &OPUSPacket{PacketData: []byte{0xFB, 0x84, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1}}
+	assert.NoError(t, packet.readPacketConfig(), "Valid packet is rejected")
+	assert.Equal(t, 4, len(packet.frames), "Wrong number of frames")
+
+	// code 3 CBR packet with padding
+	packet = &OPUSPacket{PacketData: []byte{0xFB, 0x42, 2, 1, 1, 1, 1, 0, 0}}
+	assert.NoError(t, packet.readPacketConfig(), "Padded packet is rejected")
+	assert.Equal(t, [][]byte{{1, 1}, {1, 1}}, packet.frames, "Wrong frames")
+	assert.Equal(t, []byte{0, 0}, packet.Padding(), "Wrong padding")
+
+	frames, err := packet.FramesWithDuration()
+	assert.NoError(t, err)
+	assert.Equal(t, []OpusFrame{{[]byte{1, 1}, 20 * time.Millisecond}, {[]byte{1, 1}, 20 * time.Millisecond}}, frames, "Wrong frames")
+}
+
+func TestSummary(t *testing.T) {
+	ogg, err := os.Open("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ogg.Close()
+
+	reader, err := NewOpusReader(ogg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary := reader.Summary()
+	assert.Equal(t, 2, summary.Channels, "Wrong channel count")
+	assert.Equal(t, "Lavf58.42.101", summary.Vendor, "Wrong vendor name")
+	assert.Equal(t, 541, summary.Packets, "Wrong number of packets")
+	assert.InDelta(t, 10.8135, summary.DurationSeconds, 1e-9, "Wrong duration")
+	assert.True(t, summary.MinBitrate <= summary.AverageBitrate, "Average bitrate is below minimum")
+	assert.True(t, summary.AverageBitrate <= summary.MaxBitrate, "Average bitrate is above maximum")
+	assert.Equal(t, []string{"Lavc58.80.100 libopus"}, summary.Comments["ENCODER"], "Wrong encoder comment")
+	assert.Equal(t, summary.AudioBytes, reader.TotalAudioBytes(), "Wrong total audio bytes")
+	assert.Equal(t, int(reader.TotalAudioBytes()*8*48000/(541*960-312)), reader.AverageBitrate(), "Wrong average bitrate")
+}
+
+func TestPageChecksum(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, page := range splitPages(data) {
+		page = append([]byte(nil), page...)
+		expected := binary.LittleEndian.Uint32(page[22:26])
+		binary.LittleEndian.PutUint32(page[22:26], 0)
+		assert.Equal(t, expected, pageChecksum(page), "Wrong checksum of page %d", i)
+	}
+}
+
+func TestRepageByDuration(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	writer, err := NewOggWriter(&out, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RepageByDuration(NewOpusReaderBytes(data), writer, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages := splitPages(out.Bytes())
+	assert.Equal(t, 2+6, len(pages), "Wrong number of pages")
+	assert.Equal(t, int64(518712), int64(binary.LittleEndian.Uint64(pages[7][6:14])), "Wrong last granule")
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	count := 0
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+	assert.Equal(t, 10813500, reader.Duration, "Wrong duration")
+	assert.Equal(t, "Lavf58.42.101", string(reader.VendorName), "Wrong vendor name")
+}
+
+func TestNextStream(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chained := append(append([]byte(nil), data...), data...)
+
+	reader := NewOpusReaderBytes(chained)
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			if err := reader.NextStream(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		count := 0
+		for !reader.LastPacket {
+			packet, err := reader.NextPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, count == 0, packet.IsFirstAudioPacket, "Wrong first packet flag")
+			count++
+		}
+		assert.Equal(t, 541, count, "Wrong number of packets of stream %d", i)
+	}
+	assert.Equal(t, 2*10813500, reader.Duration, "Wrong duration")
+	assert.Equal(t, 2, len(reader.AllComments), "Wrong number of comment sets")
+	assert.Equal(t, io.EOF, reader.NextStream(), "Missing end of chain")
+}
+
+func TestReadOpusFrameLength(t *testing.T) {
+	cases := []struct {
+		data   []byte
+		length int
+		n      int
+	}{
+		{[]byte{0}, 0, 1},
+		{[]byte{251, 7}, 251, 1},
+		{[]byte{252, 0}, 252, 2},
+		{[]byte{253, 1}, 257, 2},
+		{[]byte{255, 255}, 1275, 2},
+	}
+	for _, c := range cases {
+		length, n, err := ReadOpusFrameLength(c.data)
+		assert.NoError(t, err)
+		assert.Equal(t, c.length, length, "Wrong length of %v", c.data)
+		assert.Equal(t, c.n, n, "Wrong bytes consumed of %v", c.data)
+	}
+
+	_, _, err := ReadOpusFrameLength(nil)
+	assert.Error(t, err, "Empty data is accepted")
+	_, _, err = ReadOpusFrameLength([]byte{252})
+	assert.Error(t, err, "Truncated length is accepted")
+}
+
+func TestSkeleton(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := splitPages(data)
+
+	head := make([]byte, 64)
+	copy(head, skeletonHeadPrefix)
+	binary.LittleEndian.PutUint16(head[8:10], 4)
+	binary.LittleEndian.PutUint64(head[12:20], 3)
+	binary.LittleEndian.PutUint64(head[20:28], 2)
+
+	bone := make([]byte, 52)
+	copy(bone, skeletonBonePrefix)
+	binary.LittleEndian.PutUint32(bone[8:12], 44)
+	binary.LittleEndian.PutUint32(bone[12:16], binary.LittleEndian.Uint32(pages[0][14:18]))
+	binary.LittleEndian.PutUint32(bone[16:20], 2)
+	binary.LittleEndian.PutUint64(bone[20:28], 48000)
+	binary.LittleEndian.PutUint64(bone[28:36], 1)
+	bone = append(bone, "Content-Type: audio/opus\r\n"...)
+
+	var stream bytes.Buffer
+	skeleton, _ := NewOggWriter(&stream, 7)
+	skeleton.WritePacket(head, 0)
+	skeleton.FlushPage(false)
+	stream.Write(pages[0])
+	stream.Write(pages[1])
+	skeleton.WritePacket(bone, 0)
+	skeleton.FlushPage(true)
+	for _, page := range pages[2:] {
+		stream.Write(page)
+	}
+
+	reader := NewOpusReaderBytes(stream.Bytes())
+	reader.OGGReader.ParseSkeleton = true
+	count := 0
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+
+	if assert.NotNil(t, reader.OGGReader.Skeleton, "Skeleton head is not parsed") {
+		assert.Equal(t, 1500*time.Millisecond, reader.OGGReader.Skeleton.PresentationTime(), "Wrong presentation time")
+	}
+	if assert.Equal(t, 1, len(reader.OGGReader.SkeletonBones), "Wrong number of bones") {
+		bone := reader.OGGReader.SkeletonBones[0]
+		assert.Equal(t, uint32(2555783837), bone.Serial, "Wrong bone serial")
+		assert.Equal(t, "audio/opus", bone.Headers["Content-Type"], "Wrong content type")
+	}
+}
+
+func TestDroppedPartialStart(t *testing.T) {
+	var out bytes.Buffer
+	writer, _ := NewOggWriter(&out, 1)
+	writer.WritePacket(bytes.Repeat([]byte{1}, 100), 960)
+	// spans the end of the first page, the whole second one and the start of
+	// the third one
+	writer.WritePacket(bytes.Repeat([]byte{2}, 600*255+10), 1920)
+	writer.WritePacket(bytes.Repeat([]byte{3}, 50), 2880)
+	writer.FlushPage(true)
+	data := out.Bytes()
+	pages := splitPages(data)
+	if !assert.Equal(t, 3, len(pages), "Wrong number of pages") {
+		return
+	}
+
+	for _, start := range []int{1, 2} {
+		var stream []byte
+		for _, page := range pages[start:] {
+			stream = append(stream, page...)
+		}
+		reader, _ := NewOggReader(bytes.NewReader(stream))
+		packet, err := reader.NextPacket()
+		if assert.NoError(t, err) {
+			assert.Equal(t, bytes.Repeat([]byte{3}, 50), packet, "Partial packet is returned")
+		}
+		assert.True(t, reader.DroppedPartialStart, "Dropped fragment is not reported")
+	}
+
+	reader, _ := NewOggReader(bytes.NewReader(data))
+	_, err := reader.seekPage(int64(len(pages[0])))
+	assert.NoError(t, err)
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.Equal(t, bytes.Repeat([]byte{3}, 50), packet, "Partial packet is returned")
+	}
+	assert.False(t, reader.DroppedPartialStart, "Fragment dropped after seeking is reported")
+}
+
+func TestWithHash(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	h := sha256.New()
+	reader.OGGReader.WithHash(h)
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := sha256.Sum256(data)
+	assert.Equal(t, expected[:], h.Sum(nil), "Wrong digest")
+	assert.Equal(t, int64(len(data)), reader.OGGReader.BytesRead(), "Wrong number of bytes read")
+}
+
+func TestWithHashEmptyLastPage(t *testing.T) {
+	var out bytes.Buffer
+	writer, _ := NewOggWriter(&out, 1)
+	writer.WritePacket(OPUSIDHeader{Version: 1, ChannelCount: 1}.marshal(), 0)
+	writer.FlushPage(false)
+	writer.WritePacket(marshalTags("vendor", nil), 0)
+	writer.FlushPage(false)
+	for i := 1; i <= 3; i++ {
+		writer.WritePacket([]byte{0xf8, 0xff, 0xfe}, int64(i*960))
+	}
+	writer.FlushPage(false)
+	// the end of stream flag is set on a page without segments
+	writer.FlushPage(true)
+	data := out.Bytes()
+
+	reader := NewOpusReaderBytes(data)
+	h := sha256.New()
+	reader.OGGReader.WithHash(h)
+	count := 0
+	for !reader.LastPacket {
+		_, err := reader.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+
+	assert.Equal(t, 3, count, "Wrong number of packets")
+	expected := sha256.Sum256(data)
+	assert.Equal(t, expected[:], h.Sum(nil), "Wrong digest")
+	assert.Equal(t, int64(len(data)), reader.OGGReader.BytesRead(), "Wrong number of bytes read")
+}
+
+func TestIsOpus(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := IsOpus(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.True(t, ok, "Opus file is not detected")
+
+	ok, err = IsOpus(bytes.NewReader(data[47:]))
+	assert.NoError(t, err)
+	assert.False(t, ok, "Tags page is detected as opus")
+
+	ok, err = IsOpus(bytes.NewReader(data[:30]))
+	assert.NoError(t, err)
+	assert.False(t, ok, "Truncated file is detected as opus")
+}
+
+func TestOpusWriter(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 5, OPUSIDHeader{ChannelCount: 1, PreSkip: 100, InputSampleRate: 16000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Comments = []string{"TITLE=test"}
+
+	// 20ms SILK packets
+	packet := []byte{0x08, 1, 2, 3}
+	for i := 0; i < 3; i++ {
+		if err := writer.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WritePacketWithGranule(packet, 5000, true); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := splitPages(out.Bytes())
+	if !assert.Equal(t, 4, len(pages), "Wrong number of pages") {
+		return
+	}
+	assert.Equal(t, int64(2880), int64(binary.LittleEndian.Uint64(pages[2][6:14])), "Wrong derived granule")
+	assert.Equal(t, int64(5000), int64(binary.LittleEndian.Uint64(pages[3][6:14])), "Wrong explicit granule")
+	assert.Equal(t, uint8(headerFlagEndOfStream), pages[3][5], "Missing EOS flag")
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	count := 0
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.Equal(t, 4, count, "Wrong number of packets")
+	assert.Equal(t, uint16(100), reader.PreSkip, "Wrong pre-skip")
+	assert.Equal(t, uint32(16000), reader.InputSampleRate, "Wrong input sample rate")
+	assert.Equal(t, []string{"TITLE=test"}, reader.Comments, "Wrong comments")
+}
+
+func TestTagsCorruption(t *testing.T) {
+	tags := marshalTags("vendor", []string{"A=1", "B=2"})
+
+	var out bytes.Buffer
+	writer, _ := NewOggWriter(&out, 1)
+	writer.WritePacket(OPUSIDHeader{ChannelCount: 2}.marshal(), 0)
+	writer.FlushPage(false)
+	// the second comment length runs past the end of the packet
+	writer.WritePacket(tags[:len(tags)-1], 0)
+	writer.FlushPage(true)
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	_, err := reader.NextPacket()
+	var headerErr *HeaderError
+	assert.True(t, errors.As(err, &headerErr), "Not a header error %v", err)
+	var tagsErr *TagsError
+	if assert.True(t, errors.As(err, &tagsErr), "Wrong error %v", err) {
+		assert.Equal(t, 8+4+6+4+4+3, tagsErr.Offset, "Wrong offset")
+	}
+}
+
+func TestCurrentPageBytes(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewOggReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied []byte
+	for {
+		_, err := reader.NextPage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied = append(copied, reader.CurrentPageBytes()...)
+	}
+	assert.Equal(t, data, copied, "Pages are not passed through unchanged")
+}
+
+func TestSetSkip(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	reader.SetSkip(1000)
+	samples := []int{}
+	for i := 0; i < 3; i++ {
+		packet, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, packet.TotalSamples)
+	}
+	assert.Equal(t, []int{0, 960 - (1000 - (960 - 312)), 960}, samples, "Wrong trimmed samples")
+	assert.Equal(t, int64(3*960-312), reader.Position(), "Trimmed samples don't advance position")
+}
+
+func TestReadChunk(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	buf := make([]byte, 4096)
+	total := 0
+	for {
+		n, packets, err := reader.ReadChunk(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for offset := 0; offset < n; {
+			offset += 4 + int(binary.BigEndian.Uint32(buf[offset:]))
+			packets--
+		}
+		assert.Equal(t, 0, packets, "Wrong number of packets in chunk")
+		total++
+	}
+	assert.Equal(t, 541, reader.packetCount, "Wrong number of packets")
+	assert.Equal(t, 10813500, reader.Duration, "Wrong duration")
+	assert.True(t, total > 1, "Packets are not split into chunks")
+}
+
+func TestAmbisonicHeader(t *testing.T) {
+	read := func(header []byte) (*OPUSReader, error) {
+		var out bytes.Buffer
+		writer, _ := NewOggWriter(&out, 1)
+		writer.WritePacket(header, 0)
+		writer.FlushPage(false)
+		writer.WritePacket(marshalTags("vendor", nil), 0)
+		writer.FlushPage(true)
+
+		reader := NewOpusReaderBytes(out.Bytes())
+		return reader, reader.readHeaders()
+	}
+
+	header := OPUSIDHeader{ChannelCount: 6, ChannelMappingFamily: MappingFamilyAmbisonic}.marshal()
+	header = append(header, 6, 0, 0, 1, 2, 3, 4, 5)
+	reader, err := read(header)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, reader.AmbisonicOrder, "Wrong ambisonic order")
+		assert.Equal(t, []byte{0, 1, 2, 3, 4, 5}, reader.ChannelMapping, "Wrong channel mapping")
+		assert.True(t, reader.IsCompatible(), "Ambisonic stream is not compatible")
+	}
+
+	header = OPUSIDHeader{ChannelCount: 5, ChannelMappingFamily: MappingFamilyAmbisonic}.marshal()
+	header = append(header, 5, 0, 0, 1, 2, 3, 4)
+	_, err = read(header)
+	assert.Error(t, err, "Invalid ambisonic channels count is accepted")
+
+	header = OPUSIDHeader{ChannelCount: 4, ChannelMappingFamily: MappingFamilyAmbisonicProjection}.marshal()
+	header = append(header, 2, 2)
+	header = append(header, make([]byte, 2*4*4)...)
+	reader, err = read(header)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, reader.AmbisonicOrder, "Wrong ambisonic order")
+		assert.Equal(t, 32, len(reader.DemixingMatrix), "Wrong demixing matrix size")
+	}
+}
+
+// generateStream returns an in-memory stream of the given number of 20ms
+// packets, 50 packets per page
+func generateStream(packets int) []byte {
+	packet := make([]byte, 160)
+	packet[0] = 0xFC // CELT FB 20ms stereo
+	data := make([][]byte, packets)
+	for i := range data {
+		data[i] = packet
+	}
+	return generatePacketsStream(data)
+}
+
+// generatePacketsStream returns a stream of the packets, 50 per page
+func generatePacketsStream(packets [][]byte) []byte {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 2, PreSkip: 312, InputSampleRate: 48000})
+	if err != nil {
+		panic(err)
+	}
+
+	for i, packet := range packets {
+		writer.WritePacket(packet)
+		if i%50 == 49 && i < len(packets)-1 {
+			writer.FlushPage()
+		}
+	}
+	writer.Close()
+	return out.Bytes()
+}
+
+func TestOnConfigChange(t *testing.T) {
+	var packets [][]byte
+	for _, toc := range []byte{0xFC, 0xF8, 0x7C} {
+		packet := make([]byte, 160)
+		packet[0] = toc
+		for i := 0; i < 30; i++ {
+			packets = append(packets, packet)
+		}
+	}
+
+	reader := NewOpusReaderBytes(generatePacketsStream(packets))
+	var changes [][2]OPUSPacketConfig
+	reader.OnConfigChange = func(prev, cur OPUSPacketConfig) {
+		changes = append(changes, [2]OPUSPacketConfig{prev, cur})
+	}
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if assert.Equal(t, 2, len(changes), "Wrong number of calls") {
+		// stereo to mono
+		assert.Equal(t, uint8(31), changes[0][0].ConfigCode, "Wrong previous config")
+		assert.Equal(t, uint8(1), changes[0][0].SoundMode, "Wrong previous sound mode")
+		assert.Equal(t, uint8(31), changes[0][1].ConfigCode, "Wrong config")
+		assert.Equal(t, uint8(0), changes[0][1].SoundMode, "Wrong sound mode")
+		// CELT to hybrid
+		assert.Equal(t, uint8(0), changes[1][0].SoundMode, "Wrong previous sound mode")
+		assert.Equal(t, uint8(15), changes[1][1].ConfigCode, "Wrong config")
+		assert.Equal(t, uint8(1), changes[1][1].SoundMode, "Wrong sound mode")
+	}
+}
+
+func TestSkipBadPackets(t *testing.T) {
+	good := make([]byte, 160)
+	good[0] = 0xFC
+	// code 3 packet declaring more than the 48 frames allowed
+	bad := []byte{0xFF, 49, 0, 0}
+	var packets [][]byte
+	for i := 0; i < 10; i++ {
+		packets = append(packets, good)
+		if i == 1 || i == 5 {
+			packets = append(packets, bad)
+		}
+	}
+	data := generatePacketsStream(packets)
+
+	reader := NewOpusReaderBytes(data)
+	reader.SkipBadPackets = true
+	count := 0
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.Equal(t, 10, count, "Wrong number of packets")
+	assert.Equal(t, 2, reader.BadPacketCount, "Wrong number of bad packets")
+
+	reader = NewOpusReaderBytes(data)
+	var err error
+	for count = 0; err == nil; count++ {
+		_, err = reader.NextPacket()
+	}
+	var packetErr *PacketError
+	assert.True(t, errors.As(err, &packetErr), "Bad packet isn't reported %v", err)
+	assert.Equal(t, 3, count, "Bad packet isn't reported in order")
+	assert.Equal(t, 0, reader.BadPacketCount, "Reported packet is counted")
+}
+
+func TestSilenceRatio(t *testing.T) {
+	audio := make([]byte, 160)
+	audio[0] = 0xFC
+	// DTX packets carry only the TOC byte
+	dtx := []byte{0xFC}
+	var packets [][]byte
+	for i := 0; i < 40; i++ {
+		if i%4 == 3 {
+			packets = append(packets, dtx)
+		} else {
+			packets = append(packets, audio)
+		}
+	}
+
+	ratio, err := NewOpusReaderBytes(generatePacketsStream(packets)).SilenceRatio()
+	if assert.NoError(t, err) {
+		// the pre-skip is trimmed from the first packet
+		assert.Equal(t, float64(10*960)/float64(40*960-312), ratio, "Wrong silence ratio")
+	}
+
+	ratio, err = NewOpusReaderBytes(generateStream(10)).SilenceRatio()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0.0, ratio, "Audio is counted as silence")
+	}
+}
+
+func TestWriteWAVHeader(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, WriteWAVHeader(&out, 2, 192000))
+
+	expected := []byte{
+		'R', 'I', 'F', 'F', 0x24, 0xEE, 0x02, 0x00, 'W', 'A', 'V', 'E',
+		'f', 'm', 't', ' ', 16, 0, 0, 0,
+		1, 0, // PCM
+		2, 0, // channels
+		0x80, 0xBB, 0x00, 0x00, // 48000 Hz
+		0x00, 0xEE, 0x02, 0x00, // 192000 bytes per second
+		4, 0, // block align
+		16, 0, // bits per sample
+		'd', 'a', 't', 'a', 0x00, 0xEE, 0x02, 0x00,
+	}
+	assert.Equal(t, expected, out.Bytes(), "Wrong header")
+
+	assert.Error(t, WriteWAVHeader(&out, 0, 0), "Invalid channels count is accepted")
+}
+
+func BenchmarkNextPacket(b *testing.B) {
+	data := generateStream(1000)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader, _ := NewOpusReader(bytes.NewReader(data))
+		for !reader.LastPacket {
+			if _, err := reader.NextPacket(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReadPage(b *testing.B) {
+	data := generateStream(1000)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader, _ := NewOggReader(bytes.NewReader(data))
+		for {
+			_, err := reader.NextPage()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkParseHeaders(b *testing.B) {
+	data := generateStream(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader, _ := NewOpusReader(bytes.NewReader(data))
+		if err := reader.readHeaders(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMissingEOS(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append([]byte(nil), data...)
+	pages := splitPages(data)
+	last := pages[len(pages)-1]
+	last[5] &^= headerFlagEndOfStream
+
+	reader := NewOpusReaderBytes(data)
+	count := 0
+	for !reader.EndOfStream() {
+		_, err := reader.NextPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+	assert.True(t, reader.EndOfStream(), "End of stream is not detected")
+	assert.False(t, reader.LastPacket, "Missing EOS page is reported as read")
+
+	// truncation in the middle of the last page is an error
+	reader = NewOpusReaderBytes(data[:len(data)-100])
+	for !reader.EndOfStream() {
+		_, err = reader.NextPacket()
+		if err != nil {
+			break
+		}
+	}
+	var packetErr *PacketError
+	assert.True(t, errors.As(err, &packetErr), "Not a packet error %v", err)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "Truncation is not detected")
+	assert.False(t, reader.LastPacket, "Truncated stream is reported as complete")
+}
+
+func TestReadPastEOS(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, err = reader.NextPacket()
+		assert.Equal(t, io.EOF, err, "Reading past the EOS page isn't io.EOF")
+	}
+}
+
+func TestParseOpusHead(t *testing.T) {
+	header, err := ParseOpusHead(OPUSIDHeader{ChannelCount: 2, PreSkip: 312, InputSampleRate: 44100}.marshal())
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint8(2), header.ChannelCount, "Wrong channel count")
+		assert.Equal(t, uint16(312), header.PreSkip, "Wrong pre-skip")
+		assert.Equal(t, uint32(44100), header.InputSampleRate, "Wrong input sample rate")
+	}
+
+	_, err = ParseOpusHead([]byte("OpusHead\x01\x02"))
+	assert.Error(t, err, "Truncated header is accepted")
+	_, err = ParseOpusHead(OPUSIDHeader{ChannelCount: 3}.marshal())
+	assert.Error(t, err, "3 channels are accepted for mapping 0")
+}
+
+func TestParseOpusHeadRTPChannels(t *testing.T) {
+	_, err := ParseOpusHead(OPUSIDHeader{Version: 1, ChannelCount: 3, ChannelMappingFamily: MappingFamilyRTP}.marshal())
+	assert.EqualError(t, err, "opusreader: channels count > 2 for channel mapping 0")
+
+	header, err := ParseOpusHead(OPUSIDHeader{Version: 1, ChannelCount: 2, ChannelMappingFamily: MappingFamilyRTP}.marshal())
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint8(1), header.StreamCount, "Wrong stream count")
+		assert.Equal(t, uint8(1), header.CoupledCount, "Wrong coupled count")
+	}
+	header, err = ParseOpusHead(OPUSIDHeader{Version: 1, ChannelCount: 1, ChannelMappingFamily: MappingFamilyRTP}.marshal())
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint8(0), header.CoupledCount, "Wrong coupled count")
+	}
+}
+
+func TestParseOpusTags(t *testing.T) {
+	vendor, comments, err := ParseOpusTags(marshalTags("vendor", []string{"A=1", "B=2"}))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "vendor", vendor, "Wrong vendor")
+		assert.Equal(t, []string{"A=1", "B=2"}, comments, "Wrong comments")
+	}
+
+	_, _, err = ParseOpusTags([]byte("OpusTags\xff\xff\xff\xff"))
+	assert.Error(t, err, "Vendor length past the end is accepted")
+	_, _, err = ParseOpusTags([]byte("OpusTag"))
+	assert.Error(t, err, "Invalid prefix is accepted")
+}
+
+func TestPageGranuleDeltas(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	ogg, err := NewOggReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	deltas, err := ogg.PageGranuleDeltas()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 12, len(deltas), "Wrong number of deltas")
+		total := int64(0)
+		for _, delta := range deltas {
+			total += delta
+		}
+		assert.Equal(t, int64(518712), total, "Deltas don't add up to the last granule")
+	}
+	assert.Equal(t, int64(0), ogg.BytesRead(), "Reading position isn't preserved")
+
+	ogg, err = NewOggReader(bytes.NewBuffer(data))
+	assert.NoError(t, err)
+	_, err = ogg.PageGranuleDeltas()
+	assert.Error(t, err, "Non seekable stream is accepted")
+}
+
+func TestOpusReaderBuffered(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	// bytes.Buffer isn't seekable
+	reader, err := NewOpusReaderBuffered(bytes.NewBuffer(data))
+	assert.NoError(t, err)
+	duration, err := reader.TotalDuration()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10800*time.Millisecond, duration, "Wrong total duration")
+	}
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, packet.IsFirstAudioPacket, "Reading position isn't preserved")
+	}
+}
+
+func TestPacketIndexInPage(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 2, PreSkip: 312, InputSampleRate: 48000})
+	assert.NoError(t, err)
+	// two segments per packet, so the 128th packet crosses the page split
+	// at 255 segments
+	packet := make([]byte, 300)
+	packet[0] = 0xFC
+	for i := 0; i < 130; i++ {
+		assert.NoError(t, writer.WritePacket(packet))
+	}
+	assert.NoError(t, writer.Close())
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	continued := 0
+	for i := 0; !reader.LastPacket; i++ {
+		packet, err := reader.NextPacket()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if packet.WasContinued {
+			continued++
+			assert.Equal(t, 127, i, "Wrong continued packet")
+			assert.Equal(t, 0, packet.PacketIndexInPage, "Wrong index of the continued packet")
+		}
+		if i == 128 {
+			assert.Equal(t, 1, packet.PacketIndexInPage, "Wrong index in page")
+		}
+	}
+	assert.Equal(t, 1, continued, "Wrong number of continued packets")
+}
+
+func TestOpusReaderWithHeader(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	var audio []byte
+	for _, page := range splitPages(data)[2:] {
+		audio = append(audio, page...)
+	}
+
+	head, err := NewOpusReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, head.readHeaders())
+
+	reader, err := NewOpusReaderWithHeader(bytes.NewReader(audio), head.OPUSIDHeader)
+	assert.NoError(t, err)
+	packets := 0
+	for !reader.LastPacket {
+		packet, err := reader.NextPacket()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, packets == 0, packet.IsFirstAudioPacket, "Wrong first audio packet")
+		packets++
+	}
+	assert.Equal(t, 541, packets, "Wrong number of packets")
+	assert.Equal(t, 10813500, reader.Duration, "Wrong duration")
+
+	_, err = NewOpusReaderWithHeader(bytes.NewReader(audio), OPUSIDHeader{})
+	assert.Error(t, err, "Header without channels is accepted")
+}
+
+func TestRepageOpusReaderWithHeader(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+	var audio []byte
+	for _, page := range splitPages(data)[2:] {
+		audio = append(audio, page...)
+	}
+	head, err := ParseOpusHead(splitPages(data)[0][28:])
+	assert.NoError(t, err)
+
+	reader, err := NewOpusReaderWithHeader(bytes.NewReader(audio), head)
+	assert.NoError(t, err)
+	var out bytes.Buffer
+	writer, err := NewOggWriter(&out, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, RepageByDuration(reader, writer, time.Second))
+
+	repaged := NewOpusReaderBytes(out.Bytes())
+	packets := 0
+	for !repaged.LastPacket {
+		if _, err := repaged.NextPacket(); !assert.NoError(t, err) {
+			return
+		}
+		packets++
+	}
+	assert.Equal(t, 541, packets, "Wrong number of packets")
+	assert.Equal(t, head.PreSkip, repaged.PreSkip, "Wrong pre-skip")
+}
+
+func TestMarshalChannelMapping(t *testing.T) {
+	head := OPUSIDHeader{ChannelCount: 3, ChannelMappingFamily: MappingFamilyVorbis, StreamCount: 2, CoupledCount: 1, ChannelMapping: []byte{0, 2, 1}}
+	parsed, err := ParseOpusHead(head.marshalWithMapping())
+	if assert.NoError(t, err) {
+		assert.Equal(t, head.ChannelMapping, parsed.ChannelMapping, "Mapping table doesn't round-trip")
+		assert.Equal(t, uint8(2), parsed.StreamCount, "Wrong streams count")
+	}
+}
+
+func TestOnError(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	pages := splitPages(data)
+	offset := 0
+	for _, page := range pages[:5] {
+		offset += len(page)
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[offset+4] = 1 // unsupported version
+
+	reader, err := NewOpusReader(bytes.NewReader(corrupted))
+	assert.NoError(t, err)
+	var offsets []int64
+	reader.OnError = func(err error, offset int64) bool {
+		offsets = append(offsets, offset)
+		return true
+	}
+	count := 0
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); !assert.NoError(t, err) {
+			return
+		}
+		count++
+	}
+	assert.Equal(t, []int64{int64(offset)}, offsets, "Wrong error offsets")
+	assert.Equal(t, 491, count, "Wrong number of packets after resync")
+
+	reader, err = NewOpusReader(bytes.NewReader(corrupted))
+	assert.NoError(t, err)
+	reader.OnError = func(err error, offset int64) bool { return false }
+	for err == nil {
+		_, err = reader.NextPacket()
+	}
+	assert.EqualError(t, err, "ogg: unsupported version", "Error isn't propagated")
+}
+
+func TestAudioOnTagsPage(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOggWriter(&out, 1)
+	assert.NoError(t, err)
+	head := OPUSIDHeader{Version: 1, ChannelCount: 2, PreSkip: 312, InputSampleRate: 48000}
+	assert.NoError(t, writer.WritePacket(head.marshal(), 0))
+	assert.NoError(t, writer.FlushPage(false))
+	assert.NoError(t, writer.WritePacket(marshalTags("vendor", nil), 0))
+	packet := make([]byte, 160)
+	packet[0] = 0xFC
+	for i := 1; i <= 10; i++ {
+		packet[1] = byte(i)
+		assert.NoError(t, writer.WritePacket(append([]byte(nil), packet...), int64(960*i)))
+	}
+	assert.NoError(t, writer.FlushPage(true))
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	first, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, first.IsFirstAudioPacket, "First audio packet isn't flagged")
+		assert.Equal(t, byte(1), first.PacketData[1], "Wrong first audio packet")
+		assert.Equal(t, "vendor", string(reader.VendorName), "Wrong vendor name")
+	}
+
+	granule, err := reader.FirstAudioGranule()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(9600), granule, "Wrong first audio granule")
+	}
+	packets, err := reader.TailPackets(10)
+	if assert.NoError(t, err) && assert.Equal(t, 10, len(packets), "Wrong number of packets") {
+		assert.Equal(t, byte(1), packets[0].PacketData[1], "First audio packet is lost when seeking")
+	}
+}
+
+func TestFirstAudioGranule(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	granule, err := reader.FirstAudioGranule()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(50*960), granule, "Wrong first audio granule")
+	}
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, packet.IsFirstAudioPacket, "Reading position isn't preserved")
+	}
+
+	// without seeking it's known only once the first audio packet was read
+	reader, err = NewOpusReader(io.MultiReader(bytes.NewReader(data)))
+	assert.NoError(t, err)
+	_, err = reader.FirstAudioGranule()
+	assert.Error(t, err, "Granule is found in a stream which isn't seekable")
+	_, err = reader.NextPacket()
+	assert.NoError(t, err)
+	granule, err = reader.FirstAudioGranule()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(50*960), granule, "Wrong first audio granule")
+	}
+}
+
+func TestRemainingDuration(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	reader := NewOpusReaderBytes(data)
+	remaining, err := reader.RemainingDuration()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10800*time.Millisecond, remaining, "Wrong duration before reading")
+	}
+	for i := 0; i < 100; i++ {
+		_, err := reader.NextPacket()
+		assert.NoError(t, err)
+	}
+	remaining, err = reader.RemainingDuration()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10800*time.Millisecond-samplesToDuration(100*960-312), remaining, "Wrong remaining duration")
+	}
+	for !reader.LastPacket {
+		_, err := reader.NextPacket()
+		assert.NoError(t, err)
+	}
+	remaining, err = reader.RemainingDuration()
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Duration(0), remaining, "Wrong duration at the end")
+	}
+
+	reader, err = NewOpusReader(bytes.NewBuffer(data))
+	assert.NoError(t, err)
+	_, err = reader.RemainingDuration()
+	assert.Error(t, err, "Non seekable stream is accepted")
+}
+
+func TestEstimatedLoudness(t *testing.T) {
+	reader := &OPUSReader{Comments: []string{"r128_track_gain=-512"}, initialized: true}
+	lufs, ok := reader.EstimatedLoudness()
+	assert.True(t, ok, "R128 tag is ignored")
+	assert.Equal(t, -21.0, lufs, "Wrong loudness from the R128 tag")
+
+	reader = &OPUSReader{Comments: []string{"R128_TRACK_GAIN=loud"}, initialized: true}
+	lufs, ok = reader.EstimatedLoudness()
+	assert.False(t, ok, "Invalid R128 tag is used")
+	assert.Equal(t, -70.0, lufs, "Wrong loudness without audio")
+
+	reader = &OPUSReader{audioBytes: 8000, samples: 48000, initialized: true}
+	lufs, ok = reader.EstimatedLoudness()
+	assert.False(t, ok, "Estimate is flagged as tagged")
+	assert.Equal(t, -23.0, lufs, "Wrong estimated loudness")
+
+	// the tags of a reader which didn't read a packet yet
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 2, PreSkip: 312, InputSampleRate: 48000})
+	assert.NoError(t, err)
+	writer.Comments = []string{"R128_TRACK_GAIN=-512"}
+	assert.NoError(t, writer.WritePacket([]byte{0xFC}))
+	assert.NoError(t, writer.Close())
+	lufs, ok = NewOpusReaderBytes(out.Bytes()).EstimatedLoudness()
+	assert.True(t, ok, "R128 tag of the unread headers is ignored")
+	assert.Equal(t, -21.0, lufs, "Wrong loudness from the R128 tag")
+}
+
+func TestGroupedStreams(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	// a second stream beginning together with the first one
+	pages := splitPages(data)
+	other := append([]byte(nil), pages[0]...)
+	binary.LittleEndian.PutUint32(other[14:18], 42)
+	stream := append(append([]byte(nil), pages[0]...), other...)
+	for _, page := range pages[1:] {
+		stream = append(stream, page...)
+	}
+
+	reader, err := NewOpusReader(bytes.NewReader(stream))
+	assert.NoError(t, err)
+	streams, err := reader.OGGReader.Streams()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []uint32{2555783837, 42}, streams, "Wrong streams")
+	}
+	assert.Equal(t, int64(0), reader.OGGReader.BytesRead(), "Pages read ahead are counted")
+
+	track := reader.Track(2555783837)
+	count := 0
+	for !track.LastPacket {
+		if _, err := track.NextPacket(); !assert.NoError(t, err) {
+			return
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+	assert.Equal(t, int64(len(stream)), reader.OGGReader.BytesRead(), "Wrong number of bytes read")
+}
+
+func TestLastPacketLacing(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 2, PreSkip: 312, InputSampleRate: 48000})
+	assert.NoError(t, err)
+	for _, size := range []int{510, 300, 10} {
+		packet := make([]byte, size)
+		packet[0] = 0xFC
+		assert.NoError(t, writer.WritePacket(packet))
+	}
+	assert.NoError(t, writer.Close())
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	assert.Nil(t, reader.LastPacketLacing(), "Lacing before the first packet")
+	for _, lacing := range [][]byte{{255, 255, 0}, {255, 45}, {10}} {
+		_, err := reader.NextPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, lacing, reader.LastPacketLacing(), "Wrong lacing values")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	// the connection stalls after the first audio page
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go server.Write(data[:137+len(splitPages(data)[2])])
+
+	reader, err := NewOpusReader(client)
+	assert.NoError(t, err)
+	reader.ReadTimeout = 50 * time.Millisecond
+	for i := 0; i < 50; i++ {
+		if _, err := reader.NextPacket(); !assert.NoError(t, err) {
+			return
+		}
+	}
+	_, err = reader.NextPacket()
+	assert.True(t, errors.Is(err, ErrTimeout), "Wrong error %v", err)
+}
+
+func TestSourceDuration(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 1, PreSkip: 100, InputSampleRate: 8000})
+	assert.NoError(t, err)
+	packet := []byte{0x08} // SILK NB 20ms mono
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, writer.WritePacket(packet))
+	}
+	assert.NoError(t, writer.Close())
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	for !reader.LastPacket {
+		_, err := reader.NextPacket()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int64(9500), reader.Position(), "Wrong position")
+	assert.Equal(t, 9500*1000000/48000, reader.Duration, "Wrong duration")
+	// 9500 samples at 48kHz are 1583 whole samples at 8kHz
+	assert.Equal(t, 1583*time.Second/8000, reader.SourceDuration(), "Wrong source duration")
+	total, err := reader.TotalDuration()
+	if assert.NoError(t, err) {
+		assert.Equal(t, samplesToDuration(9500), total, "Wrong total duration")
+	}
+}
+
+func TestSplitByDuration(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	var segments []*bytes.Buffer
+	err = SplitByDuration(NewOpusReaderBytes(data), 3*time.Second, func(index int) (io.Writer, error) {
+		assert.Equal(t, len(segments), index, "Wrong segment index")
+		segments = append(segments, new(bytes.Buffer))
+		return segments[index], nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var counts []int
+	for _, segment := range segments {
+		reader := NewOpusReaderBytes(segment.Bytes())
+		count := 0
+		for !reader.LastPacket {
+			packet, err := reader.NextPacket()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, count == 0, packet.IsFirstAudioPacket, "Wrong first audio packet")
+			count++
+		}
+		assert.Equal(t, "Lavf58.42.101", string(reader.VendorName), "Headers aren't copied")
+		counts = append(counts, count)
+	}
+	assert.Equal(t, []int{150, 150, 150, 91}, counts, "Wrong number of packets per segment")
+
+	total, err := NewOpusReaderBytes(segments[0].Bytes()).TotalDuration()
+	if assert.NoError(t, err) {
+		assert.Equal(t, samplesToDuration(150*960-312), total, "Wrong duration of the first segment")
+	}
+}
+
+func TestSplitOpusReaderWithHeader(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+	var audio []byte
+	for _, page := range splitPages(data)[2:] {
+		audio = append(audio, page...)
+	}
+	head, err := ParseOpusHead(splitPages(data)[0][28:])
+	assert.NoError(t, err)
+
+	reader, err := NewOpusReaderWithHeader(bytes.NewReader(audio), head)
+	assert.NoError(t, err)
+	var segments []*bytes.Buffer
+	err = SplitByDuration(reader, 3*time.Second, func(index int) (io.Writer, error) {
+		segments = append(segments, new(bytes.Buffer))
+		return segments[index], nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var counts []int
+	for _, segment := range segments {
+		reader := NewOpusReaderBytes(segment.Bytes())
+		count := 0
+		for !reader.LastPacket {
+			if _, err := reader.NextPacket(); !assert.NoError(t, err) {
+				return
+			}
+			count++
+		}
+		assert.Equal(t, head.PreSkip, reader.PreSkip, "Wrong pre-skip")
+		counts = append(counts, count)
+	}
+	assert.Equal(t, []int{150, 150, 150, 91}, counts, "Wrong number of packets per segment")
+}
+
+func TestHasConstantConfig(t *testing.T) {
+	constant, config, err := NewOpusReaderBytes(generateStream(100)).HasConstantConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, constant, "Constant config isn't detected")
+		assert.Equal(t, uint8(31), config, "Wrong config code")
+	}
+
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 1, PreSkip: 312})
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WritePacket([]byte{0xF8}))
+	assert.NoError(t, writer.WritePacket([]byte{0x08}))
+	assert.NoError(t, writer.Close())
+	constant, _, err = NewOpusReaderBytes(out.Bytes()).HasConstantConfig()
+	if assert.NoError(t, err) {
+		assert.False(t, constant, "Config change isn't detected")
+	}
+}
+
+func TestVendorString(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 1, PreSkip: 312})
+	assert.NoError(t, err)
+	writer.VendorName = "enc\xffoder"
+	assert.NoError(t, writer.Close())
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	assert.NoError(t, reader.ensureHeaders())
+	assert.False(t, reader.VendorValid, "Invalid vendor name is flagged as valid")
+	assert.Equal(t, "enc�oder", reader.VendorString(), "Wrong vendor string")
+	assert.Equal(t, "enc�oder", reader.Summary().Vendor, "Wrong vendor in the summary")
+
+	reader = NewOpusReaderBytes(generateStream(1))
+	assert.NoError(t, reader.ensureHeaders())
+	assert.True(t, reader.VendorValid, "Valid vendor name is flagged as invalid")
+	assert.Equal(t, "oggopus", reader.VendorString(), "Wrong vendor string")
+}
+
+func TestCommentsUTF8(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 1, PreSkip: 312})
+	assert.NoError(t, err)
+	writer.VendorName = "v"
+	writer.Comments = []string{"TITLE=ok", "ARTIST=b\xffd"}
+	assert.NoError(t, writer.Close())
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	assert.NoError(t, reader.ensureHeaders())
+	assert.Equal(t, "ARTIST=b\xffd", reader.Comments[1], "Invalid comment is modified")
+	if assert.Equal(t, 1, len(reader.CommentErrors), "Wrong number of invalid comments") {
+		assert.EqualError(t, reader.CommentErrors[0], "opusreader: invalid tags header at offset 29: comment 1 is not valid UTF-8")
+	}
+
+	reader = NewOpusReaderBytes(out.Bytes())
+	reader.SanitizeComments = true
+	assert.NoError(t, reader.ensureHeaders())
+	assert.Equal(t, []string{"TITLE=ok", "ARTIST=b�d"}, reader.Comments, "Invalid comment isn't sanitized")
+	assert.Equal(t, 1, len(reader.CommentErrors), "Sanitized comment isn't reported")
+}
+
+func TestCurrentGranule(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	reader := NewOpusReaderBytes(data)
+	assert.Equal(t, int64(-1), reader.CurrentGranule(), "Granule before reading")
+	for i := 0; i < 51; i++ {
+		_, err := reader.NextPacket()
+		assert.NoError(t, err)
+		if i == 0 {
+			assert.Equal(t, int64(48000), reader.CurrentGranule(), "Wrong granule of the first page")
+		}
+	}
+	assert.Equal(t, int64(96000), reader.CurrentGranule(), "Wrong granule of the second page")
+}
+
+func TestHeadersEndOffset(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	reader := NewOpusReaderBytes(data)
+	offset, err := reader.HeadersEndOffset()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(137), offset, "Wrong end of the headers")
+	}
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, packet.IsFirstAudioPacket, "Audio packet is consumed")
+	}
+
+	// a reader of the audio part only
+	ogg, err := NewOggReader(bytes.NewReader(data[offset:]))
+	assert.NoError(t, err)
+	first, err := ogg.NextPacket()
+	if assert.NoError(t, err) {
+		assert.Equal(t, packet.PacketData, first, "Wrong first packet after the headers")
+	}
+
+	_, err = NewOpusReaderBytes(data[:100]).HeadersEndOffset()
+	assert.Error(t, err, "Truncated headers are accepted")
+}
+
+func TestOutputGranule(t *testing.T) {
+	packet := &OPUSPacket{GranulePosition: 960}
+	assert.Equal(t, int64(648), packet.OutputGranule(312), "Wrong output granule")
+	assert.Equal(t, int64(0), packet.OutputGranule(3840), "Output granule isn't clamped")
+	packet.GranulePosition = -1
+	assert.Equal(t, int64(-1), packet.OutputGranule(312), "Unknown granule is converted")
+
+	reader := NewOpusReaderBytes(generateStream(10))
+	for !reader.LastPacket {
+		packet, err := reader.NextPacket()
+		assert.NoError(t, err)
+		assert.Equal(t, reader.Position(), packet.OutputGranule(reader.PreSkip), "Output granule differs from the position")
+	}
+}
+
+func TestTrailingGarbage(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+	data = append(data, []byte("this is not an ogg page, it's trailing garbage")...)
+
+	ogg, err := NewOggReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	count := 0
+	for {
+		_, err := ogg.NextPacket()
+		if err != nil {
+			assert.Equal(t, io.EOF, err, "Garbage after EOS isn't ignored")
+			break
+		}
+		count++
+	}
+	assert.Equal(t, 543, count, "Wrong number of packets")
+
+	ogg, err = NewOggReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	ogg.HeaderOnly = true
+	for err == nil {
+		_, err = ogg.NextPage()
+	}
+	assert.Equal(t, io.EOF, err, "Garbage after EOS isn't ignored in the header only mode")
+
+	total, err := NewOpusReaderBytes(data).TotalDuration()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10800*time.Millisecond, total, "Wrong total duration")
+	}
+
+	// garbage in the middle of the stream is still an error
+	corrupted := append([]byte(nil), data[:137]...)
+	corrupted = append(corrupted, "garbage"...)
+	ogg, err = NewOggReader(bytes.NewReader(corrupted))
+	assert.NoError(t, err)
+	for err == nil {
+		_, err = ogg.NextPacket()
+	}
+	assert.NotEqual(t, io.EOF, err, "Garbage before EOS is ignored")
+}
+
+func TestAcceptAnyOggVersion(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+	data = append([]byte(nil), data...)
+	data[137+4] = 1
+
+	reader := NewOpusReaderBytes(data)
+	_, err = reader.NextPacket()
+	assert.EqualError(t, err, "ogg: unsupported version", "Unknown version is accepted by default")
+
+	reader = NewOpusReaderBytes(data)
+	reader.OGGReader.AcceptAnyOggVersion = true
+	count := 0
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); !assert.NoError(t, err) {
+			return
+		}
+		if count == 0 {
+			assert.Equal(t, uint8(1), reader.OGGReader.CurrentPage.Version, "Wrong page version")
+		}
+		count++
+	}
+	assert.Equal(t, 541, count, "Wrong number of packets")
+	assert.Equal(t, 1, reader.OGGReader.UnknownVersionPages, "Wrong number of unknown version pages")
+}
+
+func TestOnProgress(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	reader := NewOpusReaderBytes(data)
+	var samples int64
+	count := 0
+	reader.OnProgress = func(s int64, d time.Duration) {
+		assert.True(t, s > samples, "Progress doesn't advance")
+		assert.Equal(t, samplesToDuration(s), d, "Wrong duration")
+		samples = s
+		count++
+	}
+	buf := make([]byte, 1000)
+	for {
+		_, _, err := reader.ReadChunk(buf)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+	}
+	assert.Equal(t, 541, count, "Wrong number of calls")
+	assert.Equal(t, reader.Position(), samples, "Wrong samples of the last call")
+}
+
+func TestOnPacket(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	reader := NewOpusReaderBytes(data)
+	var previous int64
+	count := 0
+	reader.OnPacket = func(packet *OPUSPacket, granule int64) {
+		assert.Equal(t, 20*time.Millisecond, packet.Duration(), "Wrong packet duration")
+		if count < 500 {
+			assert.Equal(t, durationToSamples(packet.Duration()), granule-previous, "Wrong granule progression")
+		}
+		previous = granule
+		count++
+	}
+	for !reader.LastPacket {
+		_, err := reader.NextPacket()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 541, count, "Wrong number of calls")
+	assert.Equal(t, int64(518712), previous, "Wrong granule of the last packet")
+}
+
+func TestOnPacketUnread(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	reader := NewOpusReaderBytes(data)
+	count := 0
+	reader.OnPacket = func(packet *OPUSPacket, granule int64) {
+		count++
+	}
+	buf := make([]byte, 1000)
+	for {
+		_, _, err := reader.ReadChunk(buf)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			break
+		}
+	}
+	assert.Equal(t, 541, count, "Packets put back are reported twice")
+
+	reader = NewOpusReaderBytes(data)
+	count = 0
+	reader.OnPacket = func(packet *OPUSPacket, granule int64) {
+		count++
+	}
+	assert.NoError(t, reader.SkipTo(4800))
+	skipped := count
+	_, err = reader.NextPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, skipped, count, "Packet put back by SkipTo is reported twice")
+}
+
+func TestTagsCommentsCount(t *testing.T) {
+	tags := marshalTags("vendor", []string{"A=1", "B=2"})
+	binary.LittleEndian.PutUint32(tags[8+4+6:], 50)
+
+	vendor, comments, err := ParseOpusTags(tags)
+	assert.Equal(t, "vendor", vendor, "Wrong vendor")
+	assert.Equal(t, []string{"A=1", "B=2"}, comments, "Comments present are dropped")
+	assert.EqualError(t, err, "opusreader: invalid tags header at offset 36: declared comments count 50 exceeds the 2 comments present")
+
+	var out bytes.Buffer
+	writer, _ := NewOggWriter(&out, 1)
+	writer.WritePacket(OPUSIDHeader{ChannelCount: 2}.marshal(), 0)
+	writer.FlushPage(false)
+	writer.WritePacket(tags, 0)
+	writer.FlushPage(true)
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	assert.NoError(t, reader.ensureHeaders())
+	assert.Equal(t, []string{"A=1", "B=2"}, reader.Comments, "Wrong comments")
+	assert.Equal(t, 1, len(reader.CommentErrors), "Missing comments aren't reported")
+}
+
+func TestBuildStreamTree(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	tree, err := BuildStreamTree(bytes.NewReader(data))
+	if !assert.NoError(t, err) || !assert.Equal(t, 1, len(tree.Streams), "Wrong number of streams") {
+		return
+	}
+	stream := tree.Streams[0]
+	assert.Equal(t, uint32(2555783837), stream.Serial, "Wrong serial")
+	if assert.NotNil(t, stream.Header, "Opus header isn't parsed") {
+		assert.Equal(t, uint16(312), stream.Header.PreSkip, "Wrong pre-skip")
+	}
+	if !assert.Equal(t, 13, len(stream.Pages), "Wrong number of pages") {
+		return
+	}
+	assert.True(t, stream.Pages[0].Flags.BeginningOfStream, "Wrong flags of the first page")
+	assert.Equal(t, int64(137), stream.Pages[2].Offset, "Wrong page offset")
+	assert.Equal(t, int64(518712), stream.Pages[12].GranulePosition, "Wrong last granule")
+
+	packets := 0
+	for _, page := range stream.Pages {
+		packets += len(page.Packets)
+	}
+	assert.Equal(t, 543, packets, "Wrong number of packets")
+	assert.Nil(t, stream.Pages[1].Packets[0].Config, "Tags header has a config")
+
+	first := stream.Pages[2].Packets[0]
+	assert.Equal(t, int64(137+27+120), first.Offset, "Wrong packet offset")
+	if assert.NotNil(t, first.Config, "Missing config") && assert.NoError(t, first.Err) {
+		total := time.Duration(0)
+		for _, frame := range first.Frames {
+			total += frame.Duration
+		}
+		assert.Equal(t, 20*time.Millisecond, total, "Wrong duration of the frames")
+	}
+}
+
+func TestBuildStreamTreeContinued(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 2, PreSkip: 312})
+	assert.NoError(t, err)
+	packet := make([]byte, 300)
+	packet[0] = 0xFC
+	for i := 0; i < 130; i++ {
+		assert.NoError(t, writer.WritePacket(packet))
+	}
+	assert.NoError(t, writer.Close())
+
+	tree, err := BuildStreamTree(bytes.NewReader(out.Bytes()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	pages := tree.Streams[0].Pages
+	if assert.Equal(t, 4, len(pages), "Wrong number of pages") {
+		assert.Equal(t, 127, len(pages[2].Packets), "Wrong number of packets on the first audio page")
+		continued := pages[3].Packets[0]
+		assert.Equal(t, 2, continued.Pages, "Wrong number of pages of the continued packet")
+		assert.Equal(t, 300, continued.Size, "Wrong size of the continued packet")
+		assert.Equal(t, pages[2].Offset+int64(27+255+127*300), continued.Offset, "Wrong offset of the continued packet")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	assert.NoError(t, err)
+
+	reader := NewOpusReaderBytes(data)
+	assert.NoError(t, reader.ensureHeaders())
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, reader.OPUSIDHeader)
+	assert.NoError(t, err)
+	writer.Comments = reader.Comments
+
+	count := 0
+	err = Transform(reader, writer, func(packet *OPUSPacket) []byte {
+		count++
+		switch {
+		case count%10 == 0:
+			// dropped
+			return nil
+		case count%2 == 0:
+			// silence with the same TOC
+			return packet.PacketData[:1]
+		}
+		return packet.PacketData
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	transformed := NewOpusReaderBytes(out.Bytes())
+	packets := 0
+	silent := 0
+	for !transformed.LastPacket {
+		packet, err := transformed.NextPacket()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if len(packet.PacketData) == 1 {
+			silent++
+		}
+		packets++
+	}
+	assert.Equal(t, 541-54, packets, "Wrong number of packets")
+	assert.Equal(t, 270-54, silent, "Wrong number of replaced packets")
+	assert.Equal(t, reader.Comments, transformed.Comments, "Wrong comments")
+	total, err := transformed.TotalDuration()
+	if assert.NoError(t, err) {
+		assert.Equal(t, samplesToDuration(int64(packets*960-312)), total, "Wrong granule positions")
+	}
+}
+
+func TestRawTags(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 1, PreSkip: 312})
+	assert.NoError(t, err)
+	writer.VendorName = "vendor"
+	writer.Comments = []string{"TITLE=title"}
+	assert.NoError(t, writer.Close())
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	assert.NoError(t, reader.ensureHeaders())
+	assert.Equal(t, marshalTags(reader.VendorString(), reader.Comments), reader.RawTags, "Tags don't round-trip")
+}
+
+// Decodes every packet to samples alternating between 0.9 and 0.8
+type constantDecoder struct{}
+
+func (constantDecoder) Decode(packet []byte, pcm []float32) (int, error) {
+	n := getPacketSamples(packet)
+	for i := 0; i < n; i++ {
+		pcm[i] = 0.9 - float32(i%2)*0.1
+	}
+	return n, nil
+}
+
+func TestDecodeAllClipping(t *testing.T) {
+	var out bytes.Buffer
+	// +3 dB of output gain and -2 dB of track gain
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 1, PreSkip: 312, OutputGain: 768})
+	assert.NoError(t, err)
+	writer.Comments = []string{"R128_TRACK_GAIN=-512"}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, writer.WritePacket([]byte{0xf8, 0, 0}))
+	}
+	assert.NoError(t, writer.Close())
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	var samples int
+	err = reader.DecodeAll(constantDecoder{}, func(pcm []float32) error {
+		samples += len(pcm)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3*960-312, samples, "Wrong number of samples")
+	assert.Equal(t, int64((3*960-312)/2), reader.ClippedSampleCount, "Wrong number of clipped samples")
+}
+
+func TestReorderWindow(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := splitPages(data)
+
+	readAll := func(stream []byte, window int) ([][]byte, *OPUSReader) {
+		reader := NewOpusReaderBytes(stream)
+		reader.OGGReader.ReorderWindow = window
+		var packets [][]byte
+		for !reader.LastPacket {
+			packet, err := reader.NextPacket()
+			if !assert.NoError(t, err) {
+				break
+			}
+			packets = append(packets, packet.PacketData)
+		}
+		return packets, reader
+	}
+	join := func(order ...int) []byte {
+		var stream []byte
+		for _, i := range order {
+			stream = append(stream, pages[i]...)
+		}
+		return stream
+	}
+
+	// page 4 arrives one page early and page 7 three pages late, past the
+	// window, so it's lost
+	expected, _ := readAll(join(0, 1, 2, 3, 4, 5, 6, 8, 9, 10, 11, 12), 0)
+	packets, reader := readAll(join(0, 1, 2, 4, 3, 5, 6, 8, 9, 10, 7, 11, 12), 2)
+	assert.Equal(t, expected, packets, "Wrong packets")
+	assert.Equal(t, 1, reader.OGGReader.LatePages, "Wrong number of late pages")
+}
+
+func TestStreamDurations(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 2, OPUSIDHeader{ChannelCount: 1, PreSkip: 312})
+	assert.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, writer.WritePacket([]byte{0xf8}))
+	}
+	assert.NoError(t, writer.Close())
+	chained := append(append([]byte(nil), data...), out.Bytes()...)
+
+	reader := NewOpusReaderBytes(chained)
+	_, err = reader.NextPacket()
+	assert.NoError(t, err)
+	durations, err := reader.StreamDurations()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []time.Duration{10800 * time.Millisecond, time.Second - samplesToDuration(312)}, durations, "Wrong durations")
+	}
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, packet.PacketIndexInPage, "Reading position is not preserved")
+	}
+}
+
+func TestOnPageRead(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewOpusReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := make(map[int64][]byte)
+	reader.OGGReader.OnPageRead = func(offset int64, page []byte) {
+		cache[offset] = page
+	}
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var offset int64
+	for _, page := range splitPages(data) {
+		assert.Equal(t, page, cache[offset], "Wrong page at offset %d", offset)
+		offset += int64(len(page))
+	}
+	assert.Equal(t, len(splitPages(data)), len(cache), "Wrong number of pages")
+}
+
+func TestGranulePositionByteOrder(t *testing.T) {
+	for _, tc := range []struct {
+		raw     [8]byte
+		granule int64
+	}{
+		{[8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, -1},
+		{[8]byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}, 0x0102030405060708},
+		{[8]byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}, math.MaxInt64 - 1},
+		{[8]byte{0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}, 1 << 32},
+	} {
+		page := append([]byte("OggS\x00\x02"), tc.raw[:]...)
+		page = append(page, make([]byte, 12)...)
+		page = append(page, 1, 1, 'x')
+		reader, err := NewOggReader(bytes.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := reader.NextPage()
+		if assert.NoError(t, err) {
+			assert.Equal(t, tc.granule, read.AbsoluteGranulePosition, "Wrong granule position for % x", tc.raw)
+		}
+
+		var out bytes.Buffer
+		writer, err := NewOggWriter(&out, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, writer.WritePacket([]byte{'x'}, tc.granule))
+		assert.NoError(t, writer.FlushPage(false))
+		assert.Equal(t, tc.raw[:], out.Bytes()[6:14], "Wrong written granule position %d", tc.granule)
+		reader, err = NewOggReader(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err = reader.NextPage()
+		if assert.NoError(t, err) {
+			assert.Equal(t, tc.granule, read.AbsoluteGranulePosition, "Granule position %d doesn't round-trip", tc.granule)
+		}
+	}
+}
+
+func TestOverheadRatio(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewOggReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overhead int
+	for _, page := range splitPages(data) {
+		overhead += 27 + int(page[26])
+	}
+	ratio, err := reader.OverheadRatio()
+	if assert.NoError(t, err) {
+		assert.InDelta(t, float64(overhead)/float64(len(data)), ratio, 1e-12, "Wrong overhead ratio")
+	}
+
+	unseekable, _ := NewOggReader(bytes.NewBuffer(data))
+	_, err = unseekable.OverheadRatio()
+	assert.Error(t, err, "Unseekable stream is scanned")
+}
+
+func TestRawOpusReader(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewOpusReaderBytes(data)
+	reader.CopyPackets = true
+	var packets [][]byte
+	for !reader.LastPacket {
+		packet, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet.PacketData)
+	}
+
+	for _, framing := range []PacketFraming{FramingUint16, FramingUint32, FramingUvarint} {
+		var stream []byte
+		for _, packet := range packets {
+			switch framing {
+			case FramingUint16:
+				stream = append(stream, byte(len(packet)>>8), byte(len(packet)))
+			case FramingUint32:
+				stream = append(stream, 0, 0, byte(len(packet)>>8), byte(len(packet)))
+			case FramingUvarint:
+				var prefix [binary.MaxVarintLen64]byte
+				stream = append(stream, prefix[:binary.PutUvarint(prefix[:], uint64(len(packet)))]...)
+			}
+			stream = append(stream, packet...)
+		}
+
+		raw, err := NewRawOpusReader(bytes.NewBuffer(stream), reader.OPUSIDHeader, framing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var read [][]byte
+		for {
+			packet, err := raw.NextPacket()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(t, err, "Framing %d", framing) {
+				break
+			}
+			read = append(read, packet.PacketData)
+		}
+		assert.Equal(t, packets, read, "Wrong packets for framing %d", framing)
+		assert.Equal(t, reader.Duration, raw.Duration, "Wrong duration for framing %d", framing)
+		assert.Equal(t, int64(len(stream)), raw.OGGReader.BytesRead(), "Wrong bytes read for framing %d", framing)
+	}
+
+	raw, err := NewRawOpusReader(bytes.NewBuffer([]byte{0, 10, 0xf8}), reader.OPUSIDHeader, FramingUint16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = raw.NextPacket()
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "Truncated packet is not reported")
+}
+
+func TestQuickSampleCount(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	samples, err := reader.QuickSampleCount()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(10800*48), samples, "Wrong sample count")
+	}
+	audioOffset, err := reader.HeadersEndOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, audioOffset, reader.OGGReader.BytesRead(), "Reading position is not preserved")
+
+	unseekable, err := NewOpusReader(bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = unseekable.QuickSampleCount()
+	assert.Error(t, err, "Unseekable stream is scanned")
+}
+
+func TestContainerBitrate(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewOpusReaderBytes(data)
+	bitrate, err := reader.ContainerBitrate()
+	if assert.NoError(t, err) {
+		assert.Equal(t, len(data)*8*1000/10800, bitrate, "Wrong container bitrate")
+	}
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, packet.IsFirstAudioPacket, "Reading position is not preserved")
+	}
+}
+
+func TestHasFEC(t *testing.T) {
+	for _, tc := range []struct {
+		packet []byte
+		fec    bool
+	}{
+		// mono SILK 20ms with the VAD flag, with and without the LBRR flag
+		{[]byte{0x08, 0xc0, 0x12}, true},
+		{[]byte{0x08, 0x80, 0x12}, false},
+		// stereo SILK 60ms with the VAD flags, with the side LBRR flag
+		{[]byte{0x1c, 0xef}, true},
+		{[]byte{0x1c, 0xee}, false},
+		// mid LBRR flag in the second frame of a code 1 packet
+		{[]byte{0x1d, 0xee, 0xfe}, true},
+		// hybrid 20ms
+		{[]byte{0x68, 0x40}, true},
+		// CELT and DTX frames
+		{[]byte{0xf8, 0xff}, false},
+		{[]byte{0x08}, false},
+	} {
+		packet := &OPUSPacket{PacketData: tc.packet}
+		assert.Equal(t, tc.fec, packet.HasFEC(), "Wrong FEC detection for % x", tc.packet)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewOpusReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0.0, reader.Progress(), "Progress before reading")
+	previous := 0.0
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		progress := reader.Progress()
+		assert.True(t, progress >= previous, "Progress goes back")
+		assert.Equal(t, float64(reader.OGGReader.BytesRead())/float64(len(data)), progress, "Wrong progress")
+		previous = progress
+	}
+	assert.Equal(t, 1.0, previous, "Progress at the end")
+
+	unseekable, err := NewOpusReader(bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = unseekable.NextPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, unseekable.Progress(), "Progress of an unseekable stream")
+}
+
+func TestPacketLimits(t *testing.T) {
+	for _, tc := range []struct {
+		packet []byte
+		valid  bool
+	}{
+		// 48 and 49 CELT frames of 2.5ms
+		{[]byte{0xe3, 48}, true},
+		{[]byte{0xe3, 49}, false},
+		// 2 and 3 SILK frames of 60ms
+		{[]byte{0x19, 0, 0}, true},
+		{[]byte{0x1b, 3, 0, 0, 0}, false},
+	} {
+		packet := &OPUSPacket{PacketData: tc.packet}
+		err := packet.readPacketConfig()
+		if tc.valid {
+			assert.NoError(t, err, "Valid packet % x is rejected", tc.packet)
+		} else {
+			assert.Error(t, err, "Invalid packet % x is accepted", tc.packet)
+		}
+	}
+}
+
+func TestMaxPacketDuration(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 1, OPUSIDHeader{ChannelCount: 1, PreSkip: 312})
+	assert.NoError(t, err)
+	// 20ms, 2x60ms and 10ms packets
+	for _, packet := range [][]byte{{0xf8}, {0x19, 0, 0}, {0xf0}} {
+		assert.NoError(t, writer.WritePacket(packet))
+	}
+	assert.NoError(t, writer.Close())
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	assert.Equal(t, time.Duration(0), reader.MaxPacketDuration(), "Duration before reading")
+	var durations []time.Duration
+	for !reader.LastPacket {
+		if _, err := reader.NextPacket(); err != nil {
+			t.Fatal(err)
+		}
+		durations = append(durations, reader.MaxPacketDuration())
+	}
+	assert.Equal(t, []time.Duration{20 * time.Millisecond, 120 * time.Millisecond, 120 * time.Millisecond}, durations, "Wrong maximum durations")
+}
+
+func TestExtensions(t *testing.T) {
+	withPadding := func(padding ...byte) *OPUSPacket {
+		// two CELT frames of 1 byte
+		data := append([]byte{0xfb, 0x42, byte(len(padding)), 0, 0}, padding...)
+		packet := &OPUSPacket{PacketData: data}
+		assert.NoError(t, packet.readPacketConfig())
+		return packet
+	}
+
+	extensions, err := withPadding(0x05, 0xaa, 0x02, 0xfd, 0x02, 0x11, 0x22, 0x00, 0x00).Extensions()
+	assert.NoError(t, err)
+	assert.Equal(t, []OpusExtension{
+		{ID: 2, Frame: 0, Data: []byte{0xaa}},
+		{ID: ExtensionIDDRED, Frame: 1, Data: []byte{0x11, 0x22}},
+	}, extensions, "Wrong extensions")
+
+	extensions, err = withPadding(0x01, 0x40, 0x33, 0x44).Extensions()
+	assert.NoError(t, err)
+	assert.Equal(t, []OpusExtension{{ID: 32, Data: []byte{0x33, 0x44}}}, extensions, "Wrong extension taking the rest")
+
+	extensions, err = withPadding(0, 0, 0, 0).Extensions()
+	assert.NoError(t, err)
+	assert.Empty(t, extensions, "Zero fill has extensions")
+
+	_, err = withPadding(0xfd, 0x05, 0x11).Extensions()
+	assert.Error(t, err, "Truncated extension is accepted")
+	_, err = withPadding(0x02, 0x02).Extensions()
+	assert.Error(t, err, "Extension past the last frame is accepted")
+}
+
+func TestGranuleMonotonic(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chained := append(append([]byte(nil), data...), data...)
+
+	monotonic, err := NewOpusReaderBytes(chained).GranuleMonotonic()
+	assert.NoError(t, err)
+	assert.True(t, monotonic, "Chained stream is not monotonic")
+
+	// page 3 ends past page 4
+	var swapped []byte
+	pages := splitPages(data)
+	for i, page := range pages {
+		if i == 3 {
+			page = append([]byte(nil), page...)
+			copy(page[6:14], pages[5][6:14])
+		}
+		swapped = append(swapped, page...)
+	}
+	reader := NewOpusReaderBytes(swapped)
+	_, err = reader.NextPacket()
+	assert.NoError(t, err)
+	monotonic, err = reader.GranuleMonotonic()
+	assert.NoError(t, err)
+	assert.False(t, monotonic, "Decreasing granule position is not detected")
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, packet.PacketIndexInPage, "Reading position is not preserved")
+	}
+}
+
+func TestSkipPages(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := splitPages(data)
+
+	reader, err := NewOggReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.NextPacket()
+	assert.NoError(t, err)
+	assert.NoError(t, reader.SkipPages(3))
+	_, err = reader.NextPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4), reader.CurrentPage.SequenceNumber, "Wrong page after skipping")
+
+	assert.Equal(t, io.EOF, reader.SkipPages(len(pages)), "Skipping past the end")
+}
+
+func TestEncoderOptions(t *testing.T) {
+	reader := &OPUSReader{Comments: []string{"TITLE=title"}}
+	_, ok := reader.EncoderOptions()
+	assert.False(t, ok, "Options found without the comment")
+
+	reader.Comments = append(reader.Comments, "ENCODER_OPTIONS=--bitrate 96 --vbr --comp 10 --framesize=60 --gain -3")
+	options, ok := reader.EncoderOptions()
+	assert.True(t, ok, "Options not found")
+	assert.Equal(t, map[string]string{"bitrate": "96", "vbr": "", "comp": "10", "framesize": "60", "gain": "-3"}, options, "Wrong options")
+}
+
+func TestWriteDelimited(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewOpusReaderBytes(data)
+	var out bytes.Buffer
+	assert.NoError(t, reader.WriteDelimited(&out))
+
+	reader = NewOpusReaderBytes(data)
+	delimited := out.Bytes()
+	for !reader.LastPacket {
+		packet, err := reader.NextPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := int(binary.BigEndian.Uint16(delimited))
+		assert.Equal(t, packet.PacketData, delimited[2:2+size], "Wrong packet")
+		delimited = delimited[2+size:]
+	}
+	assert.Empty(t, delimited, "Trailing data")
+}
+
+func TestTrustChannelCount(t *testing.T) {
+	// 3 channels in 2 streams with a mapping table one byte short
+	head := append(OPUSIDHeader{ChannelCount: 3, ChannelMappingFamily: MappingFamilyVorbis}.marshal(), 2, 1, 0, 1)
+	var out bytes.Buffer
+	writer, err := NewOggWriter(&out, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, writer.WritePacket(head, 0))
+	assert.NoError(t, writer.FlushPage(false))
+	assert.NoError(t, writer.WritePacket(marshalTags("vendor", nil), 0))
+	assert.NoError(t, writer.FlushPage(false))
+	assert.NoError(t, writer.WritePacket([]byte{0xf8, 0x00}, 960))
+	assert.NoError(t, writer.FlushPage(true))
+
+	reader := NewOpusReaderBytes(out.Bytes())
+	_, err = reader.NextPacket()
+	var headerErr *HeaderError
+	assert.True(t, errors.As(err, &headerErr), "Inconsistent mapping is accepted: %v", err)
+
+	reader = NewOpusReaderBytes(out.Bytes())
+	reader.TrustChannelCount = true
+	_, err = reader.NextPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 255}, reader.ChannelMapping, "Wrong repaired mapping")
+	assert.Error(t, reader.ChannelMappingError, "Repair is not reported")
+}
+
+func TestTimeAtOffset(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := splitPages(data)
+
+	reader := NewOpusReaderBytes(data)
+	at, err := reader.TimeAtOffset(0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), at, "Wrong time at the start")
+
+	// the middle of page 4 maps to the end of page 5
+	offset := len(pages[0]) + len(pages[1]) + len(pages[2]) + len(pages[3]) + len(pages[4])/2
+	granule := int64(binary.LittleEndian.Uint64(pages[5][6:14]))
+	at, err = reader.TimeAtOffset(int64(offset))
+	assert.NoError(t, err)
+	assert.Equal(t, samplesToDuration(granule-312), at, "Wrong time in the middle")
+
+	_, err = reader.TimeAtOffset(int64(len(data)))
+	assert.Error(t, err, "Time found past the end")
+	packet, err := reader.NextPacket()
+	if assert.NoError(t, err) {
+		assert.True(t, packet.IsFirstAudioPacket, "Reading position is not preserved")
+	}
+}
+
+// ReadSeeker failing the seeks to the offset failAt
+type failingSeeker struct {
+	*bytes.Reader
+	failAt int64
+}
+
+func (r *failingSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart && offset == r.failAt {
+		return 0, errors.New("seek failed")
+	}
+	return r.Reader.Seek(offset, whence)
+}
+
+func TestTailPacketsSeekError(t *testing.T) {
+	data := generateStream(2000)
+
+	// TailPackets moves to the page after the first one of the last 64 KiB
+	var offset int64
+	for _, page := range splitPages(data) {
+		start := offset
+		offset += int64(len(page))
+		if start >= int64(len(data)-seekWindow) {
+			break
+		}
+	}
+
+	reader, err := NewOpusReader(&failingSeeker{Reader: bytes.NewReader(data), failAt: offset})
+	assert.NoError(t, err)
+	_, err = reader.TailPackets(10)
+	assert.EqualError(t, err, "seek failed", "Failed seek is ignored")
+
+	reader = NewOpusReaderBytes(data)
+	_, err = reader.TailPackets(-1)
+	assert.Error(t, err, "Negative number of packets is accepted")
+	packets, err := reader.TailPackets(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(packets), "Wrong number of packets")
+}
+
+// ReaderAt recording the end of the furthest read
+type furthestReaderAt struct {
+	data     []byte
+	furthest int64
+}
+
+func (r *furthestReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := bytes.NewReader(r.data).ReadAt(p, off)
+	if end := off + int64(n); end > r.furthest {
+		r.furthest = end
+	}
+	return n, err
+}
+
+func TestOpusReaderRange(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	junk := bytes.Repeat([]byte{0xaa}, 100)
+	container := &furthestReaderAt{data: append(append(append([]byte(nil), junk...), data...), junk...)}
+
+	count := func(reader *OPUSReader) int {
+		packets := 0
+		for !reader.LastPacket {
+			_, err := reader.NextPacket()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(t, err) {
+				break
+			}
+			packets++
+		}
+		return packets
+	}
+
+	reader, err := NewOpusReaderRange(container, 100, int64(100+len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 541, count(reader), "Wrong number of packets")
+	assert.Equal(t, int64(100+len(data)), container.furthest, "Read past the end of the range")
+
+	// the range ends in the middle of page 6
+	pages := splitPages(data)
+	end := 100
+	for _, page := range pages[:6] {
+		end += len(page)
+	}
+	container.furthest = 0
+	reader, err = NewOpusReaderRange(container, 100, int64(end+len(pages[6])/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := count(reader)
+	assert.True(t, cut > 0 && cut < 541, "Wrong number of packets of the cut range %d", cut)
+	assert.Equal(t, int64(end+len(pages[6])/2), container.furthest, "Read past the end of the cut range")
+}
+
+func TestAudioEqual(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// retagged and repaginated copy
+	reader := NewOpusReaderBytes(data)
+	assert.NoError(t, reader.ensureHeaders())
+	var out bytes.Buffer
+	writer, err := NewOpusWriter(&out, 7, reader.OPUSIDHeader)
+	assert.NoError(t, err)
+	writer.Comments = []string{"TITLE=copy"}
+	assert.NoError(t, Transform(reader, writer, func(packet *OPUSPacket) []byte {
+		return packet.PacketData
+	}))
+
+	equal, err := AudioEqual(NewOpusReaderBytes(data), NewOpusReaderBytes(out.Bytes()))
+	assert.NoError(t, err)
+	assert.True(t, equal, "Copy is not equal")
+
+	prefix, err := NewOpusReaderRange(bytes.NewReader(data), 0, int64(len(data)/2))
+	assert.NoError(t, err)
+	equal, err = AudioEqual(NewOpusReaderBytes(data), prefix)
+	assert.NoError(t, err)
+	assert.False(t, equal, "Shorter copy is equal")
+
+	changed := append([]byte(nil), data...)
+	changed[len(changed)-10] ^= 1
+	equal, err = AudioEqual(NewOpusReaderBytes(data), NewOpusReaderBytes(changed))
+	assert.NoError(t, err)
+	assert.False(t, equal, "Changed copy is equal")
+}
+
+func TestKeepPositionAfterStreams(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/speech_orig.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewOggReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.Streams()
+	assert.NoError(t, err)
+	_, err = reader.PageGranuleDeltas()
+	assert.NoError(t, err)
+	_, err = reader.OverheadRatio()
+	assert.NoError(t, err)
+
+	var sequences []uint32
+	for {
+		page, err := reader.NextPage()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		sequences = append(sequences, page.SequenceNumber)
+	}
+	assert.Equal(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}, sequences, "Pages are read twice")
+	assert.Equal(t, int64(len(data)), reader.BytesRead(), "Wrong bytes read")
+}
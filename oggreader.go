@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 )
 
@@ -29,6 +30,10 @@ type OGGPage struct {
 	packetSizes  []int
 	totalSize    int
 
+	// raw header with the segment table, and raw body
+	rawHeader []byte
+	body      []byte
+
 	needsContinue bool
 }
 
@@ -41,6 +46,86 @@ type OGGReader struct {
 	lastPacket       bool
 	packetIndex      int
 	lastPagePosition int64
+
+	// DroppedPartialStart is set when the first page read has the continued
+	// packet flag, i.e. reading started mid-stream and the leading fragment
+	// of a packet was discarded. The fragments dropped after seeking within
+	// the stream don't set it.
+	DroppedPartialStart bool
+	dropContinued       bool
+	repositioned        bool
+
+	// MultiTrack enables demultiplexing of interleaved logical streams.
+	// The reader itself returns the packets of the stream of the first page
+	// it reads, the pages of the other streams are queued until they are
+	// read through Track. Queues of streams which are never read grow
+	// without bound.
+	MultiTrack bool
+	queues     map[uint32][]*OGGPage
+
+	// HeaderOnly makes the reader seek past the page bodies instead of
+	// reading them, which allows to walk the pages of a large seekable
+	// stream quickly. Packets aren't available in this mode.
+	HeaderOnly bool
+
+	// ParseSkeleton enables parsing of an Ogg Skeleton logical stream.
+	// Its pages are consumed by the reader and described by Skeleton and
+	// SkeletonBones instead of being returned.
+	ParseSkeleton  bool
+	Skeleton       *SkeletonHead
+	SkeletonBones  []SkeletonBone
+	skeletonSerial uint32
+
+	hash hash.Hash
+
+	// OnPageRead, if set, is called with the offset and a copy of the bytes
+	// of each page once it's read completely, header and segment table
+	// included, e.g. to cache the pages by offset. The bytes are nil in the
+	// HeaderOnly mode.
+	OnPageRead func(offset int64, page []byte)
+
+	// AcceptAnyOggVersion makes the reader parse the pages with a version
+	// other than 0, the only one defined, as version 0 pages instead of
+	// failing. UnknownVersionPages counts such pages.
+	AcceptAnyOggVersion bool
+	UnknownVersionPages int
+
+	// ReorderWindow, if positive, makes the reader buffer up to that many
+	// pages to return them in the order of their sequence numbers, for
+	// captures of network streams with pages slightly out of order. Pages
+	// arriving too late to be reordered are dropped and counted in
+	// LatePages. The pages are hashed and counted in BytesRead in the order
+	// they are read from the stream.
+	ReorderWindow int
+	LatePages     int
+	reorder       []*OGGPage
+	nextSequence  map[uint32]uint32
+
+	// serial numbers of the logical streams which began so far, and the
+	// pages read ahead to find the streams beginning together
+	streams    []uint32
+	bosScanned bool
+	lookahead  []*OGGPage
+
+	// number of logical streams begun and not ended yet, and whether all of
+	// them ended with the page read last, after which bytes which aren't
+	// a page are trailing garbage
+	openStreams int
+	ended       bool
+
+	// length prefix framing of the packets of a raw opus stream without
+	// pages, and the number of packets read
+	framing       *PacketFraming
+	framedPackets uint32
+
+	// set when the stream is a byte range of a larger stream, whose end may
+	// cut a page or a packet
+	bounded bool
+
+	// set for the readers returned by Track
+	parent    *OGGReader
+	serial    uint32
+	hasSerial bool
 }
 
 const (
@@ -72,33 +157,473 @@ func (o *OGGReader) ResetReader(reset func(bytesRead int64) io.Reader) {
 	o.stream = reset(o.bytesReadSuccesfully)
 }
 
-func (o *OGGReader) readPage() error {
-	o.CurrentPage = new(OGGPage)
-	if err := o.readPageHeader(); err != nil {
+// BytesRead returns the number of bytes of the pages read completely
+func (o *OGGReader) BytesRead() int64 {
+	return o.bytesReadSuccesfully
+}
+
+// WithHash makes the reader write all the bytes of the pages it reads to h,
+// so the digest of the stream is computed while parsing it. Each page is
+// written once it's read completely. Bytes skipped by seeking or in the
+// HeaderOnly mode are not hashed.
+func (o *OGGReader) WithHash(h hash.Hash) {
+	o.hash = h
+}
+
+// seeker returns the stream as an io.Seeker. The stream of a track is shared
+// with the reader it was made of, so a track can't seek it.
+func (o *OGGReader) seeker() (io.Seeker, error) {
+	if o.parent != nil {
+		return nil, errors.New("ogg: a track can't seek the shared stream")
+	}
+	seeker, ok := o.stream.(io.Seeker)
+	if !ok {
+		return nil, errors.New("ogg: stream is not seekable")
+	}
+	return seeker, nil
+}
+
+// seekPage positions the reader at the first page starting at or after
+// offset and resets the packet state. The stream has to implement io.Seeker.
+func (o *OGGReader) seekPage(offset int64) (int64, error) {
+	seeker, err := o.seeker()
+	if err != nil {
+		return 0, err
+	}
+
+	o.CurrentPage = nil
+	o.initialized = false
+	o.repositioned = true
+	o.lastPacket = false
+	o.packetIndex = 0
+	o.dropContinued = false
+	o.lookahead = nil
+	o.openStreams = 0
+	o.ended = false
+	o.reorder = nil
+	o.nextSequence = nil
+	o.queues = nil
+
+	buf := make([]byte, 4096)
+	for {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		n, err := io.ReadFull(o.stream, buf)
+		if i := bytes.Index(buf[:n], capturePattern[:]); i >= 0 {
+			offset += int64(i)
+			break
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(n - len(capturePattern) + 1)
+	}
+
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	o.bytesReadSuccesfully = offset
+
+	return offset, nil
+}
+
+// keepPosition saves the reader state and returns a function restoring it
+// after the stream was scanned with seekPage or scanPages.
+func (o *OGGReader) keepPosition() func() error {
+	saved := *o
+	offset := o.streamOffset()
+	return func() error {
+		*o = saved
+		if o.parent != nil {
+			// the shared stream wasn't moved, see seeker
+			return nil
+		}
+		_, err := o.stream.(io.Seeker).Seek(offset, io.SeekStart)
 		return err
 	}
-	if err := o.readPageContent(); err != nil {
+}
+
+// streamOffset returns the offset in the stream following the pages read,
+// which includes the pages read ahead and not returned yet
+func (o *OGGReader) streamOffset() int64 {
+	offset := o.bytesReadSuccesfully
+	for _, page := range o.lookahead {
+		offset += int64(page.size())
+	}
+	return offset
+}
+
+// scanPages walks the page headers starting from the first page at or after
+// offset, skipping the page bodies, until the end of the stream or until fn
+// returns false. The reader has to be repositioned before reading packets.
+func (o *OGGReader) scanPages(offset int64, fn func(offset int64, page *OGGPage) bool) error {
+	offset, err := o.seekPage(offset)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
+	ended := false
+	for {
+		o.CurrentPage = new(OGGPage)
+		err := o.readPageHeader(o.CurrentPage)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err != nil && ended {
+			// trailing garbage after an EOS page is ignored
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(offset, o.CurrentPage) {
+			return nil
+		}
+		ended = o.CurrentPage.isLast()
+
+		if err := o.skipPageContent(o.CurrentPage); err != nil {
+			return err
+		}
+		offset += int64(o.CurrentPage.size())
+		o.bytesReadSuccesfully = offset
+	}
+}
+
+// PageGranuleDeltas returns the differences between the granule positions
+// of consecutive pages of the first logical stream, i.e. the number of
+// samples completed on each page. Pages which don't complete a packet are
+// skipped. The stream has to be seekable, the reading position is preserved.
+func (o *OGGReader) PageGranuleDeltas() ([]int64, error) {
+	if _, err := o.seeker(); err != nil {
+		return nil, err
+	}
+
+	restore := o.keepPosition()
+	var deltas []int64
+	var serial uint32
+	previous := int64(-1)
+	first := true
+	err := o.scanPages(0, func(offset int64, page *OGGPage) bool {
+		if first {
+			serial = page.BitStreamSerialNumber
+			first = false
+		}
+		granule := page.AbsoluteGranulePosition
+		if page.BitStreamSerialNumber != serial || granule == -1 {
+			return true
+		}
+		if previous != -1 {
+			deltas = append(deltas, granule-previous)
+		}
+		previous = granule
+		return true
+	})
+	if rerr := restore(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deltas, nil
+}
+
+// OverheadRatio returns the fraction of the bytes of the pages taken by the
+// page headers and the segment tables, i.e. by the Ogg framing rather than
+// the packet data, computed over all the pages of the stream. It's 0 for
+// a stream without pages. The stream has to be seekable, the reading
+// position is preserved.
+func (o *OGGReader) OverheadRatio() (float64, error) {
+	if _, err := o.seeker(); err != nil {
+		return 0, err
+	}
+
+	restore := o.keepPosition()
+	var total, payload int64
+	err := o.scanPages(0, func(offset int64, page *OGGPage) bool {
+		total += int64(page.size())
+		payload += int64(page.totalSize)
+		return true
+	})
+	if rerr := restore(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(total-payload) / float64(total), nil
+}
+
+// firstPacketAt returns the first packet ending on the page at offset, or
+// the whole body if no packet ends on it. The reader has to be repositioned
+// before reading packets.
+func (o *OGGReader) firstPacketAt(offset int64) ([]byte, error) {
+	if _, err := o.seekPage(offset); err != nil {
+		return nil, err
+	}
+	page := new(OGGPage)
+	if err := o.readPageHeader(page); err != nil {
+		return nil, err
+	}
+	if err := o.readPageContent(page); err != nil {
+		return nil, err
+	}
+	return page.packets[0], nil
+}
 
-	o.CurrentPage.initialized = true
+// skipPageContent seeks past the body of the page instead of reading it
+func (o *OGGReader) skipPageContent(page *OGGPage) error {
+	seeker, ok := o.stream.(io.Seeker)
+	if !ok {
+		return errors.New("ogg: stream is not seekable")
+	}
+	_, err := seeker.Seek(int64(page.totalSize), io.SeekCurrent)
+	return err
+}
 
+// NextPage reads the next page of the stream. It's meant for walking the
+// page structure and shouldn't be mixed with reading packets.
+func (o *OGGReader) NextPage() (*OGGPage, error) {
+	if err := o.readPage(); err != nil {
+		return nil, err
+	}
+	return o.CurrentPage, nil
+}
+
+// SkipPages reads and discards the next n pages, along with the packets left
+// on the current page, e.g. to jump past known bad leading pages. Reading
+// packets resumes at the following page, dropping the tail of a packet
+// continued from the skipped pages. It returns io.EOF if the stream ends
+// before n pages were skipped.
+func (o *OGGReader) SkipPages(n int) error {
+	for i := 0; i < n; i++ {
+		if err := o.readPage(); err != nil {
+			return err
+		}
+		if granule := o.CurrentPage.AbsoluteGranulePosition; granule != -1 {
+			o.lastPagePosition = granule
+		}
+	}
+	o.initialized = false
+	o.packetIndex = 0
 	return nil
 }
 
-func (o *OGGReader) readPageContent() error {
-	page := o.CurrentPage
-	content := make([]byte, page.totalSize)
-	_, err := io.ReadFull(o.stream, content)
+// Track returns a reader of the packets of the logical stream with the given
+// serial number. Pages of the other streams are queued for their own tracks
+// if MultiTrack is set, and skipped otherwise. All the reading has to be done
+// through the tracks once one is used. The tracks share the stream, so the
+// methods seeking it fail on them.
+func (o *OGGReader) Track(serial uint32) *OGGReader {
+	return &OGGReader{
+		stream:    o.stream,
+		parent:    o,
+		serial:    serial,
+		hasSerial: true,
+	}
+}
+
+func (o *OGGReader) readPage() error {
+	var page *OGGPage
+	var err error
+	switch {
+	case o.parent != nil:
+		page, err = o.parent.nextPageOf(o.serial)
+	case o.MultiTrack && o.hasSerial:
+		page, err = o.nextPageOf(o.serial)
+	default:
+		page, err = o.readOrderedPage()
+		if err == nil && o.MultiTrack {
+			o.serial = page.BitStreamSerialNumber
+			o.hasSerial = true
+		}
+	}
 	if err != nil {
 		return err
 	}
-	o.bytesReadSuccesfully += int64(page.totalSize)
 
+	o.CurrentPage = page
+
+	return nil
+}
+
+// nextPageOf returns the next page of the logical stream with the given
+// serial number, queueing or skipping the pages of other streams.
+func (o *OGGReader) nextPageOf(serial uint32) (*OGGPage, error) {
+	if queue := o.queues[serial]; len(queue) > 0 {
+		o.queues[serial] = queue[1:]
+		return queue[0], nil
+	}
+
+	for {
+		page, err := o.readOrderedPage()
+		if err != nil {
+			return nil, err
+		}
+		if page.BitStreamSerialNumber == serial {
+			return page, nil
+		}
+		if o.MultiTrack {
+			if o.queues == nil {
+				o.queues = make(map[uint32][]*OGGPage)
+			}
+			o.queues[page.BitStreamSerialNumber] = append(o.queues[page.BitStreamSerialNumber], page)
+		}
+	}
+}
+
+func (o *OGGReader) readRawPage() (*OGGPage, error) {
+	var page *OGGPage
+	if len(o.lookahead) > 0 {
+		page = o.lookahead[0]
+		o.lookahead = o.lookahead[1:]
+	} else {
+		var err error
+		page, err = o.fetchPage()
+		if err == io.ErrUnexpectedEOF && o.bounded {
+			// the page is cut by the end of the range
+			return nil, io.EOF
+		}
+		if err != nil && err != io.EOF && o.ended {
+			// ignore the trailing garbage after the end of the streams
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if page.isFirst() {
+		o.openStreams++
+	}
+	if page.isLast() {
+		o.openStreams--
+	}
+	o.ended = page.isLast() && o.openStreams <= 0
+
+	// Count the page only when it was read completely, so a reader
+	// reset after a failure resumes at the beginning of the page.
+	offset := o.bytesReadSuccesfully
+	o.bytesReadSuccesfully += int64(page.size())
+	page.initialized = true
+	if o.hash != nil {
+		o.hash.Write(page.rawHeader)
+		o.hash.Write(page.body)
+	}
+	if o.OnPageRead != nil {
+		o.OnPageRead(offset, page.rawBytes())
+	}
+
+	if o.ParseSkeleton && !o.HeaderOnly {
+		skeleton, err := o.readSkeletonPage(page)
+		if err != nil {
+			return nil, err
+		}
+		if skeleton {
+			return o.readRawPage()
+		}
+	}
+
+	return page, nil
+}
+
+// fetchPage reads the next page from the stream
+func (o *OGGReader) fetchPage() (*OGGPage, error) {
+	if o.framing != nil {
+		return o.fetchFramedPacket()
+	}
+	page := new(OGGPage)
+	if err := o.readPageHeader(page); err != nil {
+		return nil, err
+	}
+	if o.HeaderOnly {
+		if err := o.skipPageContent(page); err != nil {
+			return nil, err
+		}
+	} else if err := o.readPageContent(page); err != nil {
+		return nil, err
+	}
+
+	if page.isFirst() && !o.hasStream(page.BitStreamSerialNumber) {
+		o.streams = append(o.streams, page.BitStreamSerialNumber)
+	}
+
+	return page, nil
+}
+
+func (o *OGGReader) hasStream(serial uint32) bool {
+	for _, s := range o.streams {
+		if s == serial {
+			return true
+		}
+	}
+	return false
+}
+
+// Streams returns the serial numbers of the logical streams of the physical
+// stream, in the order of their beginning of stream pages. All the streams
+// multiplexed together begin at the start of the physical stream, before any
+// data page, so when called before reading, these leading pages are read
+// ahead and the list is complete for the first group of streams. Streams
+// chained later are added as they are read.
+func (o *OGGReader) Streams() ([]uint32, error) {
+	if o.parent != nil {
+		return o.parent.Streams()
+	}
+	if !o.bosScanned && o.bytesReadSuccesfully == 0 && o.CurrentPage == nil {
+		o.bosScanned = true
+		for {
+			page, err := o.fetchPage()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			o.lookahead = append(o.lookahead, page)
+			if !page.isFirst() {
+				break
+			}
+		}
+	}
+	return append([]uint32(nil), o.streams...), nil
+}
+
+// read returns the next n bytes of the stream. In-memory streams return
+// a slice of their buffer instead of a copy.
+func (o *OGGReader) read(n int) ([]byte, error) {
+	if s, ok := o.stream.(*byteStream); ok {
+		return s.next(n)
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(o.stream, data)
+	if isTimeout(err) {
+		return nil, &timeoutError{err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (o *OGGReader) readPageContent(page *OGGPage) error {
+	content, err := o.read(page.totalSize)
+	if err != nil {
+		return err
+	}
+	page.body = content
+
+	// packets are capped so appending to them never overwrites the data
+	// following them
 	page.packets = make([][]byte, page.packetsCount+1)
 	offset := 0
 	for i, size := range page.packetSizes {
-		page.packets[i] = content[offset : offset+size]
+		page.packets[i] = content[offset : offset+size : offset+size]
 		offset += size
 	}
 	page.packets[page.packetsCount] = content[offset:]
@@ -106,14 +631,11 @@ func (o *OGGReader) readPageContent() error {
 	return nil
 }
 
-func (o *OGGReader) readPageHeader() error {
-	page := o.CurrentPage
-	data := make([]byte, 27)
-	_, err := io.ReadFull(o.stream, data)
+func (o *OGGReader) readPageHeader(page *OGGPage) error {
+	data, err := o.read(27)
 	if err != nil {
 		return err
 	}
-	o.bytesReadSuccesfully += 27
 
 	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &page.OGGPageHeader)
 	if err != nil {
@@ -123,15 +645,17 @@ func (o *OGGReader) readPageHeader() error {
 		return errors.New("ogg: missing capture pattern")
 	}
 	if page.Version != 0 {
-		return errors.New("ogg: unsupported version")
+		if !o.AcceptAnyOggVersion {
+			return errors.New("ogg: unsupported version")
+		}
+		o.UnknownVersionPages++
 	}
 
-	segmentTable := make([]byte, page.SegmentsNumber)
-	_, err = io.ReadFull(o.stream, segmentTable)
+	segmentTable, err := o.read(int(page.SegmentsNumber))
 	if err != nil {
 		return err
 	}
-	o.bytesReadSuccesfully += int64(page.SegmentsNumber)
+	page.rawHeader = append(data[:27:27], segmentTable...)
 
 	size := 0
 	page.totalSize = 0
@@ -146,15 +670,85 @@ func (o *OGGReader) readPageHeader() error {
 			size = 0
 		}
 	}
-	page.needsContinue = segmentTable[page.OGGPageHeader.SegmentsNumber-1] == 0xFF
+	page.needsContinue = page.SegmentsNumber > 0 && segmentTable[page.SegmentsNumber-1] == 0xFF
 
 	return nil
 }
 
+// dropPartialPacket discards the tail of a packet whose beginning was never
+// read. If the packet doesn't end on the current page, the next page is
+// dropped the same way.
+func (o *OGGReader) dropPartialPacket() {
+	page := o.CurrentPage
+	if page.packetsCount == 0 {
+		page.packets[0] = nil
+		o.dropContinued = true
+		return
+	}
+	o.packetIndex = 1
+}
+
+// CurrentPageSize returns the size of the current page body, without the
+// 27 bytes of the header and the segment table
+func (o *OGGReader) CurrentPageSize() int {
+	if o.CurrentPage == nil {
+		return 0
+	}
+	return o.CurrentPage.totalSize
+}
+
+// CurrentPageBytes returns the exact bytes of the current page as read from
+// the stream, header and segment table included, so the page can be passed
+// through unchanged. It returns nil in the HeaderOnly mode.
+func (o *OGGReader) CurrentPageBytes() []byte {
+	if o.CurrentPage == nil {
+		return nil
+	}
+	return o.CurrentPage.rawBytes()
+}
+
+// rawBytes returns a copy of the page as read from the stream, or nil if its
+// body was skipped
+func (p *OGGPage) rawBytes() []byte {
+	if p.body == nil && p.totalSize > 0 {
+		return nil
+	}
+	raw := make([]byte, 0, len(p.rawHeader)+len(p.body))
+	raw = append(raw, p.rawHeader...)
+	return append(raw, p.body...)
+}
+
+// Decoded header type flags of a page
+type PageFlags struct {
+	// The page starts with the continuation of a packet from the previous page
+	Continued bool
+	// First page of a logical stream
+	BeginningOfStream bool
+	// Last page of a logical stream
+	EndOfStream bool
+}
+
+// Flags decodes the header type of the page
+func (p *OGGPage) Flags() PageFlags {
+	return PageFlags{
+		Continued:         p.HeaderType&headerFlagContinuedPacket != 0,
+		BeginningOfStream: p.HeaderType&headerFlagBeginningOfStream != 0,
+		EndOfStream:       p.HeaderType&headerFlagEndOfStream != 0,
+	}
+}
+
+// size returns the size of the whole page including the header
+func (p *OGGPage) size() int {
+	return len(p.rawHeader) + p.totalSize
+}
+
 func (p *OGGPage) isFirst() bool { return p.OGGPageHeader.HeaderType&headerFlagBeginningOfStream != 0 }
 func (p *OGGPage) isLast() bool  { return p.OGGPageHeader.HeaderType&headerFlagEndOfStream != 0 }
 
 func (o *OGGReader) NextPacket() ([]byte, error) {
+	if o.HeaderOnly {
+		return nil, errors.New("ogg: packets are not available in header only mode")
+	}
 	if !o.initialized {
 		err := o.readPage()
 		if err != nil {
@@ -162,7 +756,10 @@ func (o *OGGReader) NextPacket() ([]byte, error) {
 		}
 		o.packetIndex = 0
 		if o.CurrentPage.HeaderType&headerFlagContinuedPacket != 0 {
-			o.packetIndex = 1
+			if !o.repositioned {
+				o.DroppedPartialStart = true
+			}
+			o.dropPartialPacket()
 		}
 		o.initialized = true
 	}
@@ -172,6 +769,10 @@ func (o *OGGReader) NextPacket() ([]byte, error) {
 			o.lastPagePosition = o.CurrentPage.AbsoluteGranulePosition
 		}
 		err := o.readPage()
+		if err == io.EOF && len(rest) > 0 && !o.bounded {
+			// the stream ended in the middle of a packet
+			return nil, io.ErrUnexpectedEOF
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -179,6 +780,12 @@ func (o *OGGReader) NextPacket() ([]byte, error) {
 			o.CurrentPage.packets[0] = append(rest, o.CurrentPage.packets[0]...)
 		}
 		o.packetIndex = 0
+		if o.dropContinued {
+			o.dropContinued = false
+			if o.CurrentPage.HeaderType&headerFlagContinuedPacket != 0 {
+				o.dropPartialPacket()
+			}
+		}
 		return o.NextPacket()
 	}
 	packet := o.CurrentPage.packets[o.packetIndex]
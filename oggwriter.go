@@ -0,0 +1,167 @@
+package opusreader
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Maximum number of lacing values in a page
+const maxPageSegments = 255
+
+// Packet waiting to be written with the granule position at its end
+type oggWriterPacket struct {
+	data    []byte
+	granule int64
+}
+
+// Writer of OGG pages of a single logical stream
+type OGGWriter struct {
+	stream   io.Writer
+	serial   uint32
+	sequence uint32
+
+	packets     []oggWriterPacket
+	lastGranule int64
+	finished    bool
+}
+
+var crcTable = makeCRCTable()
+
+// OGG uses the CRC-32 with the 0x04c11db7 polynomial, no reflection,
+// zero initial value and no final xor
+func makeCRCTable() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = (r << 1) ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}
+
+func pageChecksum(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = (crc << 8) ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// NewOggWriter returns a new OGGWriter writing pages of the logical stream
+// with the given serial number
+func NewOggWriter(out io.Writer, serial uint32) (*OGGWriter, error) {
+	if out == nil {
+		return nil, fmt.Errorf("stream is nil")
+	}
+
+	return &OGGWriter{
+		stream: out,
+		serial: serial,
+	}, nil
+}
+
+// WritePacket buffers the packet until the next FlushPage call. The granule
+// is the granule position at the end of the packet.
+func (w *OGGWriter) WritePacket(data []byte, granule int64) error {
+	if w.finished {
+		return errors.New("ogg: write after end of stream")
+	}
+	w.packets = append(w.packets, oggWriterPacket{data: data, granule: granule})
+	return nil
+}
+
+// FlushPage writes the buffered packets. They are put on a single page if
+// they fit, otherwise they are continued on the following pages. If last is
+// set the final page gets the end of stream flag and no more packets can be
+// written.
+func (w *OGGWriter) FlushPage(last bool) error {
+	if w.finished {
+		return errors.New("ogg: write after end of stream")
+	}
+	if len(w.packets) == 0 && !last {
+		return nil
+	}
+
+	var segments, body []byte
+	granule := int64(-1)
+	continued := false
+	midPacket := false
+	for _, packet := range w.packets {
+		data := packet.data
+		for {
+			if len(segments) == maxPageSegments {
+				if err := w.writePage(segments, body, granule, continued, false); err != nil {
+					return err
+				}
+				segments, body, granule = nil, nil, -1
+				continued = midPacket
+			}
+
+			n := len(data)
+			if n > 255 {
+				n = 255
+			}
+			segments = append(segments, byte(n))
+			body = append(body, data[:n]...)
+			data = data[n:]
+			midPacket = n == 255
+			if !midPacket {
+				granule = packet.granule
+				break
+			}
+		}
+	}
+	if granule == -1 && last {
+		granule = w.lastGranule
+	}
+	w.packets = nil
+
+	if err := w.writePage(segments, body, granule, continued, last); err != nil {
+		return err
+	}
+	w.finished = last
+
+	return nil
+}
+
+func (w *OGGWriter) writePage(segments, body []byte, granule int64, continued, last bool) error {
+	var headerType uint8
+	if continued {
+		headerType |= headerFlagContinuedPacket
+	}
+	if w.sequence == 0 {
+		headerType |= headerFlagBeginningOfStream
+	}
+	if last {
+		headerType |= headerFlagEndOfStream
+	}
+
+	page := make([]byte, 27, 27+len(segments)+len(body))
+	copy(page, capturePattern[:])
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:14], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:18], w.serial)
+	binary.LittleEndian.PutUint32(page[18:22], w.sequence)
+	page[26] = byte(len(segments))
+	page = append(page, segments...)
+	page = append(page, body...)
+	binary.LittleEndian.PutUint32(page[22:26], pageChecksum(page))
+
+	if _, err := w.stream.Write(page); err != nil {
+		return err
+	}
+	w.sequence++
+	if granule != -1 {
+		w.lastGranule = granule
+	}
+
+	return nil
+}
@@ -2,9 +2,16 @@
 package opusreader
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -22,6 +29,50 @@ type OPUSIDHeader struct {
 	InputSampleRate      uint32 // LE
 	OutputGain           uint16 // LE
 	ChannelMappingFamily uint8
+
+	// Channel mapping table, present for families other than 0
+	// https://tools.ietf.org/html/rfc7845#section-5.1.1
+	StreamCount  uint8
+	CoupledCount uint8
+	// Stream index of each channel, for families 1, 2 and 255
+	ChannelMapping []byte
+	// Demixing matrix of family 3 as little-endian int16 coefficients
+	DemixingMatrix []byte
+	// Ambisonic order of families 2 and 3
+	AmbisonicOrder int
+}
+
+// Channel mapping families
+// https://tools.ietf.org/html/rfc7845#section-5.1.1
+// https://tools.ietf.org/html/rfc8486#section-3
+const (
+	// Mono or stereo
+	MappingFamilyRTP uint8 = 0
+	// Up to 8 channels in the Vorbis order
+	MappingFamilyVorbis uint8 = 1
+	// Ambisonics with individual channels
+	MappingFamilyAmbisonic uint8 = 2
+	// Ambisonics with a demixing matrix
+	MappingFamilyAmbisonicProjection uint8 = 3
+	// Channels with no defined meaning
+	MappingFamilyDiscrete uint8 = 255
+)
+
+// MappingFamilyName returns a readable name of the channel mapping family
+func (h OPUSIDHeader) MappingFamilyName() string {
+	switch h.ChannelMappingFamily {
+	case MappingFamilyRTP:
+		return "RTP"
+	case MappingFamilyVorbis:
+		return "Vorbis"
+	case MappingFamilyAmbisonic:
+		return "Ambisonic"
+	case MappingFamilyAmbisonicProjection:
+		return "Ambisonic projection"
+	case MappingFamilyDiscrete:
+		return "Discrete"
+	}
+	return fmt.Sprintf("Unknown (%d)", h.ChannelMappingFamily)
 }
 
 // Contains fields used in TOC byte + some additional packet info
@@ -39,7 +90,35 @@ type OPUSPacketConfig struct {
 type OPUSPacket struct {
 	OPUSPacketConfig
 
+	// Raw packet data. It's a slice of the body of the page the packet was
+	// read from, shared with the other packets of the page, and for a reader
+	// of NewOpusReaderBytes it points into the caller's buffer. It can be
+	// kept, but must not be modified unless the reader has CopyPackets set.
 	PacketData []byte
+
+	// Set only for the first audio packet following the headers
+	IsFirstAudioPacket bool
+
+	// Granule position at the end of the packet, interpolated from the
+	// granule position of its page and the sample counts of the other
+	// packets on the page. -1 if unknown.
+	GranulePosition int64
+
+	// Sequence number of the page the packet ends on
+	PageSequence uint32
+
+	// Index of the packet among the packets ending on its page
+	PacketIndexInPage int
+	// Set if the beginning of the packet was read from a previous page
+	WasContinued bool
+
+	frames  [][]byte
+	padding []byte
+
+	// samples trimmed after SetSkip
+	seekSkipped int
+	// set for packets of more than one opus stream
+	multistream bool
 }
 
 // Reader object which encapsulates OGG-reader
@@ -47,14 +126,118 @@ type OPUSReader struct {
 	OGGReader *OGGReader
 
 	OPUSIDHeader
-	VendorName []byte
+	// Identification and tags header packets as read from the stream
+	RawIDHeader []byte
+	RawTags     []byte
+	VendorName  []byte
+	// Set if VendorName is valid UTF-8, as required by the specification
+	VendorValid bool
+	// User comments in the "NAME=value" form
+	Comments []string
+	// Comments of each logical stream of a chained stream read so far
+	AllComments [][]string
+	// Problems of the comments which don't prevent reading the stream, as
+	// *TagsError: the comments which aren't valid UTF-8, reported whether
+	// they are kept as is or sanitized, and a declared count of comments
+	// exceeding the comments present in the packet
+	CommentErrors []error
+	// TrustChannelCount makes the reader accept an identification header
+	// whose channel mapping table is shorter than the channel count or maps
+	// channels to streams which don't exist. The missing and invalid
+	// entries are made silent channels, i.e. 255, and the problem is
+	// reported in ChannelMappingError.
+	TrustChannelCount   bool
+	ChannelMappingError error
+	// SanitizeComments makes the reader replace the invalid UTF-8 sequences
+	// of the comments with the replacement character instead of keeping
+	// the bytes as they are
+	SanitizeComments bool
 
 	CurrentPacket *OPUSPacket
 
 	skipped     int
+	seekSkip    int
 	initialized bool
 	LastPacket  bool
 	Duration    int
+
+	// number of audio packets returned, in total and before the current
+	// logical stream of a chained stream
+	packetCount       int
+	streamFirstPacket int
+	// output samples returned, without the pre-skip
+	samples int64
+	// audio packets payload and its bitrate range
+	audioBytes int64
+	minBitrate int
+	maxBitrate int
+	// samples of the longest audio packet, including the trimmed ones
+	longestPacket int
+
+	// OnProgress, if set, is called after each audio packet with the number
+	// of output samples and the duration read so far
+	OnProgress func(samples int64, d time.Duration)
+
+	// OnPacket, if set, is called with each audio packet before it's
+	// returned and its granule position, -1 if unknown. Compared with the
+	// arrival time of the packets and their Duration, it allows to measure
+	// the jitter of a live stream.
+	OnPacket func(packet *OPUSPacket, granule int64)
+
+	// OnConfigChange, if set, is called when the config code or the sound
+	// mode of an audio packet differs from the previous packet, i.e. when
+	// the encoder switched the mode, the bandwidth, the frame size or
+	// between mono and stereo
+	OnConfigChange func(prev, cur OPUSPacketConfig)
+	lastConfig     *OPUSPacketConfig
+
+	// SkipBadPackets makes NextPacket skip packets with an invalid TOC or
+	// framing instead of returning an error. BadPacketCount counts them.
+	SkipBadPackets bool
+	BadPacketCount int
+
+	// Number of samples pushed out of [-1, 1] by the playback gain in
+	// DecodeAll
+	ClippedSampleCount int64
+
+	// OnError, if set, is called when NextPacket fails to read a page or
+	// gets an invalid packet, with the offset of the page. Returning true
+	// recovers from the error: the reader resynchronizes to the next page
+	// found after the offset, or skips the invalid packet, counting it in
+	// BadPacketCount. Returning false makes NextPacket return the error.
+	// Resynchronization needs a seekable stream.
+	OnError func(err error, offset int64) (skip bool)
+
+	// ReadTimeout, if set and the stream has a SetReadDeadline method like
+	// net.Conn, bounds the time NextPacket waits for the stream. A read
+	// exceeding it fails with an error matching ErrTimeout, the reading can
+	// be resumed with OGGReader.ResetReader.
+	ReadTimeout time.Duration
+
+	// CopyPackets makes NextPacket return packets with PacketData copied to
+	// a newly allocated slice owned by the caller
+	CopyPackets bool
+
+	// offset of the first audio page
+	audioOffset int64
+
+	// granule position of the first audio page
+	firstGranule    int64
+	hasFirstGranule bool
+
+	// packet put back to be returned by the next NextPacket call
+	pending     *OPUSPacket
+	pendingLast bool
+
+	// set when the input ended at a page boundary without the EOS flag.
+	// More pages may follow once OGGReader.ResetReader is called.
+	inputEnded bool
+
+	// size of the audio packet returned last
+	lastPacketSize int
+
+	// size of the stream, once known
+	streamLength int64
 }
 
 // Get samples number per frame
@@ -89,9 +272,110 @@ func NewOpusReader(in io.Reader) (*OPUSReader, error) {
 	}, nil
 }
 
+// NewOpusReaderWithHeader returns a OPUSReader of a stream which carries only
+// audio packets, the identification header being known from elsewhere, e.g.
+// from SDP when bridging RTP to Ogg. The header is used as if it was read
+// from the stream and no tags header is expected.
+func NewOpusReaderWithHeader(in io.Reader, head OPUSIDHeader) (*OPUSReader, error) {
+	if in == nil {
+		return nil, errors.New("opusreader: stream is nil")
+	}
+	if head.ChannelCount == 0 {
+		return nil, errors.New("opusreader: invalid channel count")
+	}
+	oggReader, _ := NewOggReader(in)
+	return &OPUSReader{
+		OGGReader:    oggReader,
+		OPUSIDHeader: head,
+		// the headers as they would be in a stream, for copying it
+		RawIDHeader: head.marshalWithMapping(),
+		RawTags:     marshalTags("", nil),
+		VendorValid: true,
+		initialized: true,
+	}, nil
+}
+
+// NewOpusReaderRange returns a OPUSReader of the pages in the byte range
+// [start, end) of r, e.g. one track of a larger file located by an index.
+// The range has to start with the page of the identification header. Nothing
+// past end is read: a page or a packet cut by the end of the range is
+// dropped and the reading ends with io.EOF as at the end of a stream. The
+// offsets reported by the reader are relative to start.
+func NewOpusReaderRange(r io.ReaderAt, start, end int64) (*OPUSReader, error) {
+	if r == nil {
+		return nil, errors.New("opusreader: stream is nil")
+	}
+	if start < 0 || end < start {
+		return nil, errors.New("opusreader: invalid byte range")
+	}
+	reader, err := NewOpusReader(io.NewSectionReader(r, start, end-start))
+	if err != nil {
+		return nil, err
+	}
+	reader.OGGReader.bounded = true
+	return reader, nil
+}
+
+// NewOpusReaderBytes returns a OPUSReader over an in-memory stream. Pages
+// and packets are sliced out of data without copying, so data must not be
+// modified while it's being read.
+func NewOpusReaderBytes(data []byte) *OPUSReader {
+	oggReader, _ := NewOggReader(&byteStream{data: data})
+	return &OPUSReader{
+		OGGReader: oggReader,
+	}
+}
+
+// NewOpusReaderBuffered reads the whole input into memory and returns
+// a OPUSReader over it, so seeking is supported even when the input itself
+// isn't seekable, e.g. for a downloaded network stream.
+func NewOpusReaderBuffered(in io.Reader) (*OPUSReader, error) {
+	if in == nil {
+		return nil, errors.New("opusreader: stream is nil")
+	}
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	return NewOpusReaderBytes(data), nil
+}
+
+// Duration returns the duration of the audio of the packet, including the
+// samples trimmed as pre-skip, i.e. the expected interval between the start
+// of the packet and the start of the next one
+func (p *OPUSPacket) Duration() time.Duration {
+	return samplesToDuration(int64(p.FramesNumber * p.SamplesNumberPerFrame))
+}
+
+// OutputGranule returns the granule position of the end of the packet in the
+// output domain, i.e. with the pre-skip of the stream subtracted and clamped
+// at 0 for the packets which are entirely skipped. It's -1 if the granule
+// position of the packet is unknown.
+func (p *OPUSPacket) OutputGranule(preSkip uint16) int64 {
+	if p.GranulePosition == -1 {
+		return -1
+	}
+	if p.GranulePosition < int64(preSkip) {
+		return 0
+	}
+	return p.GranulePosition - int64(preSkip)
+}
+
 func (p *OPUSPacket) readPacketConfig() error {
-	if len(p.PacketData) < 1 {
-		return errors.New("opusreader: invalid TOC byte")
+	var frames [][]byte
+	var padding []byte
+	if p.multistream {
+		// all the streams but the last use the self-delimiting framing,
+		// so only the TOC of the first stream is read
+		if len(p.PacketData) < 1 || (p.PacketData[0]&3 == 3 && len(p.PacketData) < 2) {
+			return errors.New("opusreader: invalid TOC byte")
+		}
+	} else {
+		var err error
+		frames, padding, err = parseFrames(p.PacketData)
+		if err != nil {
+			return err
+		}
 	}
 	p.OPUSPacketConfig = OPUSPacketConfig{
 		ConfigCode:            (p.PacketData[0] >> 3) & 31,
@@ -101,10 +385,54 @@ func (p *OPUSPacket) readPacketConfig() error {
 	}
 
 	p.OPUSPacketConfig.TotalSamples = p.FramesNumber * p.SamplesNumberPerFrame
+	if p.FramesNumber > maxPacketFrames || p.TotalSamples > maxPacketSamples {
+		return errors.New("opusreader: packet exceeds 120ms")
+	}
+
+	p.frames = frames
+	p.padding = padding
 
 	return nil
 }
 
+// Returns number of samples in packet or 0 if TOC is invalid
+func getPacketSamples(packet []byte) int {
+	if len(packet) < 1 || (packet[0]&3 == 3 && len(packet) < 2) {
+		return 0
+	}
+	return getFramesNumberInPacket(packet) * getSamplesPerFrame(packet)
+}
+
+// Interpolates the granule position at the end of the packet returned last
+// by the ogg reader. The page granule position belongs to the last packet
+// completed on the page, so the preceding packets are derived backwards from
+// it. The last page of the stream may be end-trimmed, so its packets are
+// derived forwards from the previous page and capped at its granule.
+func (o *OPUSReader) packetGranule() int64 {
+	page := o.OGGReader.CurrentPage
+	index := o.OGGReader.packetIndex - 1
+
+	if page.isLast() {
+		granule := o.OGGReader.lastPagePosition
+		for _, data := range page.packets[:index+1] {
+			granule += int64(getPacketSamples(data))
+		}
+		if page.AbsoluteGranulePosition != -1 && granule > page.AbsoluteGranulePosition {
+			granule = page.AbsoluteGranulePosition
+		}
+		return granule
+	}
+
+	if page.AbsoluteGranulePosition == -1 {
+		return -1
+	}
+	granule := page.AbsoluteGranulePosition
+	for _, data := range page.packets[index+1 : page.packetsCount] {
+		granule -= int64(getPacketSamples(data))
+	}
+	return granule
+}
+
 func getFramesNumberInPacket(packet []byte) int {
 	code := packet[0] & 3
 	if code == 0 {
@@ -128,6 +456,12 @@ func (o *OPUSReader) readHeaders() error {
 		return err
 	}
 
+	// the first audio packet may begin on the page ending the tags, in which
+	// case seeking back to the audio has to start at that page
+	o.audioOffset = o.OGGReader.bytesReadSuccesfully
+	if page := o.OGGReader.CurrentPage; o.OGGReader.packetIndex < page.packetsCount || len(page.packets[page.packetsCount]) > 0 {
+		o.audioOffset -= int64(page.size())
+	}
 	o.initialized = true
 
 	return nil
@@ -140,87 +474,413 @@ func (o *OPUSReader) readIDHeader() error {
 		return err
 	}
 
-	opusHeader := OPUSIDHeader{}
+	opusHeader, warning, err := parseOpusHead(headerPacketData, o.TrustChannelCount)
+	if err != nil {
+		return err
+	}
+	o.ChannelMappingError = warning
+
+	o.OPUSIDHeader = opusHeader
+	o.RawIDHeader = headerPacketData
+
+	return nil
+}
+
+// ParseOpusHead parses and validates an identification header packet, e.g.
+// one received out of band from another container or from SDP
+// https://tools.ietf.org/html/rfc7845#section-5.1
+func ParseOpusHead(data []byte) (OPUSIDHeader, error) {
+	opusHeader, _, err := parseOpusHead(data, false)
+	return opusHeader, err
+}
 
-	if string(headerPacketData[:8]) != opusHeadPrefix {
-		return errors.New("opusreader: invalid id header prefix")
+// parseOpusHead parses an identification header. If trustChannelCount is
+// set, a channel mapping table inconsistent with the channel count is
+// repaired and the problem is returned as the warning.
+func parseOpusHead(data []byte, trustChannelCount bool) (opusHeader OPUSIDHeader, warning, err error) {
+	if !bytes.HasPrefix(data, []byte(opusHeadPrefix)) {
+		return opusHeader, nil, errors.New("opusreader: invalid id header prefix")
+	}
+	if len(data) < 19 {
+		return opusHeader, nil, errors.New("opusreader: truncated id header")
 	}
 
-	opusHeader.Version = headerPacketData[8]
-	opusHeader.ChannelCount = headerPacketData[9]
+	copy(opusHeader.CapturePattern[:], data[:8])
+	opusHeader.Version = data[8]
+	opusHeader.ChannelCount = data[9]
 	if opusHeader.ChannelCount == 0 {
-		return errors.New("opusreader: channels count < 1")
+		return opusHeader, nil, errors.New("opusreader: channels count < 1")
 	}
 
-	opusHeader.PreSkip = binary.LittleEndian.Uint16(headerPacketData[10:12])
-	opusHeader.InputSampleRate = binary.LittleEndian.Uint32(headerPacketData[12:16])
-	opusHeader.OutputGain = binary.LittleEndian.Uint16(headerPacketData[16:18])
+	opusHeader.PreSkip = binary.LittleEndian.Uint16(data[10:12])
+	opusHeader.InputSampleRate = binary.LittleEndian.Uint32(data[12:16])
+	opusHeader.OutputGain = binary.LittleEndian.Uint16(data[16:18])
 
-	opusHeader.ChannelMappingFamily = headerPacketData[18]
-	if opusHeader.ChannelMappingFamily != 0 {
-		// TODO: support mappings > 0
-		return errors.New("opusreader: for now library supports only channel mapping 0")
+	opusHeader.ChannelMappingFamily = data[18]
+	warning, err = opusHeader.readChannelMapping(data[19:], trustChannelCount)
+	if err != nil {
+		return OPUSIDHeader{}, nil, err
 	}
 
-	o.OPUSIDHeader = opusHeader
+	return opusHeader, warning, nil
+}
 
-	return nil
+// Reads and validates the channel mapping table following the fixed part of
+// the identification header. If trustChannelCount is set, a mapping table
+// shorter than the channel count is completed and the invalid stream indices
+// are replaced with 255, i.e. silent channels, and the problem is returned
+// as the warning.
+func (h *OPUSIDHeader) readChannelMapping(data []byte, trustChannelCount bool) (warning, err error) {
+	switch h.ChannelMappingFamily {
+	case MappingFamilyRTP:
+		if h.ChannelCount > 2 {
+			// mapping 0 is either mono or stereo
+			return nil, errors.New("opusreader: channels count > 2 for channel mapping 0")
+		}
+		h.StreamCount = 1
+		h.CoupledCount = h.ChannelCount - 1
+		return nil, nil
+	case MappingFamilyVorbis:
+		if h.ChannelCount > 8 {
+			return nil, errors.New("opusreader: channels count > 8 for channel mapping 1")
+		}
+	case MappingFamilyAmbisonic, MappingFamilyAmbisonicProjection:
+		order, ok := ambisonicOrder(int(h.ChannelCount))
+		if !ok {
+			return nil, errors.New("opusreader: channels count is not valid for ambisonics")
+		}
+		h.AmbisonicOrder = order
+	case MappingFamilyDiscrete:
+	default:
+		return nil, errors.New("opusreader: unsupported channel mapping family")
+	}
+
+	if len(data) < 2 {
+		return nil, errors.New("opusreader: truncated channel mapping table")
+	}
+	h.StreamCount = data[0]
+	h.CoupledCount = data[1]
+	data = data[2:]
+	if h.StreamCount == 0 || h.CoupledCount > h.StreamCount || int(h.StreamCount)+int(h.CoupledCount) > 255 {
+		return nil, errors.New("opusreader: invalid streams count")
+	}
+	decodedChannels := int(h.StreamCount) + int(h.CoupledCount)
+
+	if h.ChannelMappingFamily == MappingFamilyAmbisonicProjection {
+		size := 2 * int(h.ChannelCount) * decodedChannels
+		if len(data) < size {
+			return nil, errors.New("opusreader: truncated demixing matrix")
+		}
+		h.DemixingMatrix = data[:size]
+		return nil, nil
+	}
+
+	if len(data) < int(h.ChannelCount) {
+		warning = errors.New("opusreader: truncated channel mapping")
+		if !trustChannelCount {
+			return nil, warning
+		}
+		mapping := bytes.Repeat([]byte{255}, int(h.ChannelCount))
+		copy(mapping, data)
+		data = mapping
+	}
+	h.ChannelMapping = data[:h.ChannelCount]
+	for i, index := range h.ChannelMapping {
+		if index != 255 && int(index) >= decodedChannels {
+			if !trustChannelCount {
+				return nil, errors.New("opusreader: invalid channel mapping")
+			}
+			if warning == nil {
+				// the table is a slice of the header packet
+				h.ChannelMapping = append([]byte(nil), h.ChannelMapping...)
+			}
+			warning = errors.New("opusreader: invalid channel mapping")
+			h.ChannelMapping[i] = 255
+		}
+	}
+	return warning, nil
 }
 
-// For now it reads only the vendor name
-// https://tools.ietf.org/html/rfc7845#section-5.2
+// Returns the ambisonic order for the channels count, which has to be
+// (order+1)^2 with optional 2 non-diegetic stereo channels
+// https://tools.ietf.org/html/rfc8486#section-3.1
+func ambisonicOrder(channels int) (int, bool) {
+	for order := 0; order <= 14; order++ {
+		ambisonic := (order + 1) * (order + 1)
+		if channels == ambisonic || channels == ambisonic+2 {
+			return order, true
+		}
+	}
+	return 0, false
+}
+
+// Reads the vendor name and the user comments
 func (o *OPUSReader) readTags() error {
 	headerPacketData, err := o.OGGReader.NextPacket()
 	if err != nil {
 		return err
 	}
 
-	if string(headerPacketData[:8]) != opusTagsPrefix {
-		return errors.New("opusreader: invalid tags header prefix")
+	vendor, comments, warning, err := parseTags(headerPacketData)
+	if err != nil {
+		return err
 	}
 
-	var vendorNameLength uint32
-	vendorNameLength = binary.LittleEndian.Uint32(headerPacketData[8:12])
-	o.VendorName = headerPacketData[12 : 12+vendorNameLength]
+	o.RawTags = headerPacketData
+	o.VendorName = vendor
+	o.VendorValid = utf8.Valid(vendor)
+	o.Comments = comments
+	o.checkComments(len(vendor))
+	if warning != nil {
+		o.CommentErrors = append(o.CommentErrors, warning)
+	}
+	o.AllComments = append(o.AllComments, o.Comments)
 
 	return nil
 }
 
-// Method for iterating over the opus packets
+// checkComments reports the comments which aren't valid UTF-8 in
+// CommentErrors, and sanitizes them if SanitizeComments is set
+func (o *OPUSReader) checkComments(vendorLength int) {
+	o.CommentErrors = nil
+	// tags prefix, vendor name and comments count
+	offset := len(opusTagsPrefix) + 4 + vendorLength + 4
+	for i, comment := range o.Comments {
+		if !utf8.ValidString(comment) {
+			o.CommentErrors = append(o.CommentErrors, &TagsError{
+				Offset: offset,
+				Reason: fmt.Sprintf("comment %d is not valid UTF-8", i),
+			})
+			if o.SanitizeComments {
+				o.Comments[i] = strings.ToValidUTF8(comment, string(utf8.RuneError))
+			}
+		}
+		offset += 4 + len(comment)
+	}
+}
+
+// VendorString returns the vendor name with the invalid UTF-8 sequences
+// written by some buggy encoders replaced by the replacement character
+func (o *OPUSReader) VendorString() string {
+	return strings.ToValidUTF8(string(o.VendorName), string(utf8.RuneError))
+}
+
+// ParseOpusTags parses a tags header packet independently of the container
+// it was read from. Errors about corrupt data are of the *TagsError type.
+// If the packet ends before the declared number of comments, the comments
+// present are returned along with the error.
+// https://tools.ietf.org/html/rfc7845#section-5.2
+func ParseOpusTags(data []byte) (vendor string, comments []string, err error) {
+	vendorName, comments, warning, err := parseTags(data)
+	if err == nil {
+		err = warning
+	}
+	return string(vendorName), comments, err
+}
+
+// parseTags returns the vendor name and the comments of a tags header. If the
+// packet ends before the declared number of comments, the comments present
+// are returned with the warning about the missing ones.
+func parseTags(data []byte) (vendor []byte, comments []string, warning, err error) {
+	if !bytes.HasPrefix(data, []byte(opusTagsPrefix)) {
+		return nil, nil, nil, errors.New("opusreader: invalid tags header prefix")
+	}
+
+	offset := len(opusTagsPrefix)
+	readLength := func(what string) (int, error) {
+		if len(data)-offset < 4 {
+			return 0, &TagsError{Offset: offset, Reason: "truncated " + what + " length"}
+		}
+		length := binary.LittleEndian.Uint32(data[offset:])
+		if uint64(length) > uint64(len(data)-offset-4) {
+			return 0, &TagsError{Offset: offset, Reason: what + " length exceeds packet size"}
+		}
+		offset += 4
+		return int(length), nil
+	}
+
+	length, err := readLength("vendor name")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	vendor = data[offset : offset+length]
+	offset += length
+
+	if len(data)-offset < 4 {
+		return nil, nil, nil, &TagsError{Offset: offset, Reason: "missing comments count"}
+	}
+	commentsCount := binary.LittleEndian.Uint32(data[offset:])
+	offset += 4
+
+	// each iteration consumes at least the 4 bytes of the comment length,
+	// so a bogus count doesn't make the loop run past the packet
+	for i := uint32(0); i < commentsCount; i++ {
+		if len(data)-offset < 4 {
+			// the packet ends before the declared count of comments
+			return vendor, comments, &TagsError{
+				Offset: offset,
+				Reason: fmt.Sprintf("declared comments count %d exceeds the %d comments present", commentsCount, i),
+			}, nil
+		}
+		length, err := readLength("comment")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		comments = append(comments, string(data[offset:offset+length]))
+		offset += length
+	}
+
+	return vendor, comments, nil, nil
+}
+
+// TagsError is returned for a corrupt tags header, e.g. one which was
+// truncated and followed by unrelated data
+type TagsError struct {
+	// Offset in the tags packet of the invalid field
+	Offset int
+	Reason string
+}
+
+func (e *TagsError) Error() string {
+	return fmt.Sprintf("opusreader: invalid tags header at offset %d: %s", e.Offset, e.Reason)
+}
+
+// HeaderError is returned for a failure to read or parse the identification
+// or the tags header, which usually means the stream isn't valid opus
+type HeaderError struct {
+	Err error
+}
+
+func (e *HeaderError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// PacketError is returned by NextPacket for a failure to read or parse an
+// audio packet once the headers were read. It may be transient for a live
+// stream, e.g. a timeout matching ErrTimeout or io.ErrUnexpectedEOF.
+type PacketError struct {
+	Err error
+}
+
+func (e *PacketError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+// Method for iterating over the opus packets. Errors are either of the
+// *HeaderError or of the *PacketError type, except io.EOF at the end of the
+// stream.
 func (o *OPUSReader) NextPacket() (*OPUSPacket, error) {
+	if o.pending != nil {
+		packet := o.pending
+		o.pending = nil
+		o.LastPacket = o.pendingLast
+		o.lastPacketSize = len(packet.PacketData)
+		o.addSamples(packet, 1)
+		// the hooks were called when the packet was read first
+		return packet, nil
+	}
+
 	if o.LastPacket {
-		return nil, errors.New("opusreader: EOS")
+		return nil, io.EOF
+	}
+
+	if err := o.setReadDeadline(); err != nil {
+		return nil, &PacketError{Err: err}
 	}
 
 	opusPacket := new(OPUSPacket)
 
-	if !o.initialized {
-		err := o.readHeaders()
-		if err != nil {
-			return nil, err
-		}
+	if err := o.ensureHeaders(); err != nil {
+		return nil, err
 	}
 
 	packetData, err := o.OGGReader.NextPacket()
-	if err != nil {
+	if err == io.EOF {
+		// the stream ended at a page boundary without the EOS flag
+		o.inputEnded = true
 		return nil, err
 	}
-
-	opusPacket.PacketData = packetData
-	err = opusPacket.readPacketConfig()
 	if err != nil {
-		return nil, err
+		if !errors.Is(err, ErrTimeout) && o.resync(err) {
+			return o.NextPacket()
+		}
+		return nil, &PacketError{Err: err}
 	}
 
+	o.inputEnded = false
 	if o.OGGReader.lastPacket {
 		o.LastPacket = true
 	}
 
-	if string(packetData[:2]) == "Op" {
+	if bytes.HasPrefix(packetData, []byte("Op")) {
 		// Just skip an additional tags
 		return o.NextPacket()
 	}
 
+	if o.CopyPackets {
+		packetData = append([]byte(nil), packetData...)
+	}
+	opusPacket.PacketData = packetData
+	opusPacket.multistream = o.StreamCount > 1
+	err = opusPacket.readPacketConfig()
+	if err != nil {
+		skip := o.SkipBadPackets
+		if !skip && o.OnError != nil {
+			offset := o.OGGReader.bytesReadSuccesfully - int64(o.OGGReader.CurrentPage.size())
+			skip = o.OnError(err, offset)
+		}
+		if !skip {
+			return nil, &PacketError{Err: err}
+		}
+		o.BadPacketCount++
+		if o.LastPacket {
+			return nil, io.EOF
+		}
+		return o.NextPacket()
+	}
+
+	if o.OnConfigChange != nil {
+		prev := o.lastConfig
+		if prev != nil && (prev.ConfigCode != opusPacket.ConfigCode || prev.SoundMode != opusPacket.SoundMode) {
+			o.OnConfigChange(*prev, opusPacket.OPUSPacketConfig)
+		}
+	}
+	config := opusPacket.OPUSPacketConfig
+	o.lastConfig = &config
+
+	opusPacket.IsFirstAudioPacket = o.packetCount == o.streamFirstPacket
+	o.packetCount++
+	o.lastPacketSize = len(packetData)
+	o.audioBytes += int64(len(packetData))
+	if samples := opusPacket.TotalSamples; samples > 0 {
+		bitrate := len(packetData) * 8 * 48000 / samples
+		if o.minBitrate == 0 || bitrate < o.minBitrate {
+			o.minBitrate = bitrate
+		}
+		if bitrate > o.maxBitrate {
+			o.maxBitrate = bitrate
+		}
+	}
+	if samples := opusPacket.FramesNumber * opusPacket.SamplesNumberPerFrame; samples > o.longestPacket {
+		o.longestPacket = samples
+	}
+	opusPacket.GranulePosition = o.packetGranule()
+	opusPacket.PageSequence = o.OGGReader.CurrentPage.SequenceNumber
+	opusPacket.PacketIndexInPage = o.OGGReader.packetIndex - 1
+	opusPacket.WasContinued = opusPacket.PacketIndexInPage == 0 && o.OGGReader.CurrentPage.Flags().Continued
+	if granule := o.OGGReader.CurrentPage.AbsoluteGranulePosition; !o.hasFirstGranule && granule != -1 {
+		o.firstGranule = granule
+		o.hasFirstGranule = true
+	}
+
 	if opusPacket.SamplesNumberPerFrame > 0 {
 		if opusPacket.FramesNumber > 0 {
 			var needsSkip int
@@ -235,10 +895,276 @@ func (o *OPUSReader) NextPacket() (*OPUSPacket, error) {
 				opusPacket.TotalSamples -= skip
 				o.skipped += skip
 			}
-			// in microseconds
-			o.Duration += opusPacket.TotalSamples * 1000000 / 48000
+			if o.seekSkip > 0 {
+				skip := o.seekSkip
+				if opusPacket.TotalSamples < skip {
+					skip = opusPacket.TotalSamples
+				}
+				opusPacket.TotalSamples -= skip
+				opusPacket.seekSkipped = skip
+				o.seekSkip -= skip
+			}
+			o.addSamples(opusPacket, 1)
 		}
 	}
 
+	if o.OnProgress != nil {
+		o.OnProgress(o.samples, samplesToDuration(o.samples))
+	}
+	if o.OnPacket != nil {
+		o.OnPacket(opusPacket, opusPacket.GranulePosition)
+	}
+
 	return opusPacket, nil
 }
+
+// Rates returns the sample rate used for decoding, which is always 48000 for
+// opus, and the original input sample rate stored in the identification
+// header. The input rate is informational and may be 0 if unspecified.
+func (o *OPUSReader) Rates() (decode int, input uint32) {
+	return 48000, o.InputSampleRate
+}
+
+// SourceDuration returns the duration of the audio read so far on the
+// timeline of the original input, i.e. counted in whole samples at the
+// InputSampleRate of the header. The decoding and all the other durations
+// always use 48000 Hz, so this is only for aligning with the source, e.g.
+// 8000 Hz telephony recordings. The decoding rate is used if the input rate
+// is unspecified.
+func (o *OPUSReader) SourceDuration() time.Duration {
+	decode, rate := o.Rates()
+	if rate == 0 {
+		rate = uint32(decode)
+	}
+	sourceSamples := o.samples * int64(rate) / int64(decode)
+	return time.Duration(sourceSamples) * time.Second / time.Duration(rate)
+}
+
+// ExpectedGainFactor returns the linear factor the decoder applies to the
+// output samples for the OutputGain of the identification header. The gain
+// is a signed Q7.8 value in dB, so the factor is
+// pow(10, int16(OutputGain)/256.0/20), which is what libopus computes.
+func (o *OPUSReader) ExpectedGainFactor() float64 {
+	gainDB := float64(int16(o.OutputGain)) / 256.0
+	return math.Pow(10, gainDB/20)
+}
+
+// Track returns a reader of the opus stream with the given serial number in
+// a multiplexed file. Set OGGReader.MultiTrack to read several interleaved
+// tracks of the same file independently. The track can't seek, e.g.
+// TotalDuration fails on it.
+func (o *OPUSReader) Track(serial uint32) *OPUSReader {
+	return &OPUSReader{
+		OGGReader: o.OGGReader.Track(serial),
+	}
+}
+
+// LastPacketLacing returns the lacing values of the segment table which framed
+// the packet returned last, so it can be put on a page with the same framing.
+// Lacing is unambiguous, so the values follow from the packet size even
+// when the packet spans several pages. It returns nil before the first
+// audio packet.
+func (o *OPUSReader) LastPacketLacing() []byte {
+	if o.packetCount == 0 {
+		return nil
+	}
+	return lacingValues(o.lastPacketSize)
+}
+
+// lacingValues returns the segment table entries of a packet of the given size
+func lacingValues(size int) []byte {
+	lacing := bytes.Repeat([]byte{255}, size/255)
+	return append(lacing, byte(size%255))
+}
+
+// resync asks OnError whether to recover from a failure to read a page and
+// moves the reader to the next page following the failed one if so
+func (o *OPUSReader) resync(err error) bool {
+	offset := o.OGGReader.bytesReadSuccesfully
+	if o.OnError == nil || !o.OnError(err, offset) {
+		return false
+	}
+	// with no page left the next read returns io.EOF
+	_, err = o.OGGReader.seekPage(offset + 1)
+	return err == nil || err == io.EOF
+}
+
+// unreadPacket puts the packet back, so it's returned by the next NextPacket
+// call. It can be used only for the packet returned last.
+func (o *OPUSReader) unreadPacket(packet *OPUSPacket) {
+	o.pending = packet
+	o.pendingLast = o.LastPacket
+	o.LastPacket = false
+	o.addSamples(packet, -1)
+}
+
+// Adds the samples of the packet to the duration and the position, or
+// removes them if sign is -1. Samples trimmed by SetSkip still advance the
+// position since they are a part of the timeline, unlike the pre-skip.
+func (o *OPUSReader) addSamples(packet *OPUSPacket, sign int) {
+	samples := packet.TotalSamples + packet.seekSkipped
+	// in microseconds
+	o.Duration += sign * samples * 1000000 / 48000
+	o.samples += int64(sign * samples)
+}
+
+// SetSkip makes the reader trim the given number of samples from the
+// following packets, on top of any remaining pre-skip. It's meant for the
+// pre-roll discarded after a seek, to let the decoder converge; opus
+// recommends at least 80ms, i.e. 3840 samples.
+func (o *OPUSReader) SetSkip(samples int) {
+	o.seekSkip = samples
+}
+
+// SkippedSamples returns the number of pre-skip samples trimmed so far. Real
+// output starts once it reaches PreSkip.
+func (o *OPUSReader) SkippedSamples() int {
+	return o.skipped
+}
+
+// CurrentGranule returns the granule position of the page the packet
+// returned last ends on, i.e. the number of samples, including the pre-skip,
+// at the end of the last packet completed on that page. It may be past the
+// packet returned last if more packets follow on the page, and it's -1 if no
+// page was read yet or the page completes no packet.
+func (o *OPUSReader) CurrentGranule() int64 {
+	if o.OGGReader.CurrentPage == nil {
+		return -1
+	}
+	return o.OGGReader.CurrentPage.AbsoluteGranulePosition
+}
+
+// Position returns the number of output samples, excluding the pre-skip,
+// read up to the end of the packet returned last. Unlike the granule
+// position it starts at 0 at the beginning of the audible output.
+func (o *OPUSReader) Position() int64 {
+	return o.samples
+}
+
+// SkipTo discards the packets which end at or before the target granule
+// position, so the next NextPacket call returns the packet containing it.
+// The pre-skip and the duration are accounted for the skipped packets. It
+// fails if the granule position of a packet is unknown, e.g. for a raw stream.
+func (o *OPUSReader) SkipTo(granule int64) error {
+	for !o.LastPacket {
+		packet, err := o.NextPacket()
+		if err != nil {
+			return err
+		}
+		if packet.GranulePosition == -1 {
+			o.unreadPacket(packet)
+			return errors.New("opusreader: granule position is unknown")
+		}
+		if packet.GranulePosition > granule {
+			o.unreadPacket(packet)
+			return nil
+		}
+	}
+	return nil
+}
+
+// Smallest encoder delay of libopus, used in the restricted low-delay mode.
+// The default modes delay by 312 samples.
+const minPlausiblePreSkip = 120
+
+// PreSkipSuspicious reports whether the pre-skip is smaller than any opus
+// encoder delay, which usually means the muxer didn't set it and the
+// playback starts with a click
+func (o *OPUSReader) PreSkipSuspicious() bool {
+	return o.PreSkip < minPlausiblePreSkip
+}
+
+// NextStream moves to the next logical stream of a chained stream once the
+// current one is read to the end. The headers of the next stream are read,
+// so VendorName, Comments and the identification header describe it.
+// Duration and Position keep counting over all the streams. It returns
+// io.EOF if there are no more streams.
+func (o *OPUSReader) NextStream() error {
+	if !o.EndOfStream() {
+		return errors.New("opusreader: current stream is not read to the end")
+	}
+
+	o.OGGReader.lastPacket = false
+	o.LastPacket = false
+	o.inputEnded = false
+	o.skipped = 0
+	o.streamFirstPacket = o.packetCount
+	o.pending = nil
+
+	err := o.readHeaders()
+	if err != nil && err != io.EOF {
+		return &HeaderError{Err: err}
+	}
+	return err
+}
+
+// IsCompatible reports whether the stream can be fully read by this package.
+// The upper four bits of Version are the major version, which has to be 0;
+// higher major versions are incompatible by definition. The channel mapping
+// family has to be one of the supported ones: 0, 1, 2, 3 or 255.
+func (h OPUSIDHeader) IsCompatible() bool {
+	if h.Version>>4 != 0 {
+		return false
+	}
+	switch h.ChannelMappingFamily {
+	case MappingFamilyRTP, MappingFamilyVorbis, MappingFamilyAmbisonic,
+		MappingFamilyAmbisonicProjection, MappingFamilyDiscrete:
+		return true
+	}
+	return false
+}
+
+// StartOffset returns the time of the first decoded sample relative to the
+// start of the presentation. It's zero or negative: the pre-skip samples are
+// decoded before the presentation start and trimmed, so a muxer has to start
+// the audio -StartOffset earlier than the video to keep them in sync.
+func (o *OPUSReader) StartOffset() time.Duration {
+	return -samplesToDuration(int64(o.PreSkip))
+}
+
+// HeadersEndOffset reads the headers if they weren't read yet and returns the
+// offset of the first page holding audio data, so another reader can seek
+// there to read the audio. It's the end of the page completing the tags
+// header, unless the first audio packet begins on that page, in which case
+// it's the start of that page.
+func (o *OPUSReader) HeadersEndOffset() (int64, error) {
+	if err := o.ensureHeaders(); err != nil {
+		return 0, err
+	}
+	return o.audioOffset, nil
+}
+
+// EndOfStream reports whether the end of the stream was reached, i.e. the
+// packet ending the EOS page was read or the input ended. A stream without
+// the EOS flag can't be known to have ended before reading past its last
+// packet, so it becomes true only once NextPacket has returned io.EOF, which
+// loops still have to handle. It's reset by the next packet read, e.g. after
+// OGGReader.ResetReader of a live stream.
+func (o *OPUSReader) EndOfStream() bool {
+	return o.LastPacket || o.inputEnded
+}
+
+// IsOpus reports whether r starts with an OGG page whose first packet is an
+// opus identification header. It reads only the page header, the segment
+// table and the first 8 bytes of the page body, and doesn't seek.
+func IsOpus(r io.Reader) (bool, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	if !bytes.Equal(header[:4], capturePattern[:]) || header[4] != 0 || header[26] == 0 {
+		return false, nil
+	}
+
+	data := make([]byte, int(header[26])+len(opusHeadPrefix))
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(data[header[26]:]) == opusHeadPrefix, nil
+}
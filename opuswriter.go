@@ -0,0 +1,156 @@
+package opusreader
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Writer of an opus stream in OGG pages
+type OPUSWriter struct {
+	OGGWriter *OGGWriter
+
+	header     OPUSIDHeader
+	VendorName string
+	// User comments in the "NAME=value" form
+	Comments []string
+
+	headersWritten bool
+	granule        int64
+}
+
+// NewOpusWriter returns a writer of an opus stream with the given serial
+// number and identification header. The header, including PreSkip, is
+// written as is; only channel mapping family 0 is supported.
+func NewOpusWriter(out io.Writer, serial uint32, header OPUSIDHeader) (*OPUSWriter, error) {
+	if header.ChannelMappingFamily != MappingFamilyRTP {
+		return nil, errors.New("opuswriter: for now library supports only channel mapping 0")
+	}
+	if header.ChannelCount < 1 || header.ChannelCount > 2 {
+		return nil, errors.New("opuswriter: invalid channels count for channel mapping 0")
+	}
+
+	oggWriter, err := NewOggWriter(out, serial)
+	if err != nil {
+		return nil, err
+	}
+	return &OPUSWriter{
+		OGGWriter:  oggWriter,
+		header:     header,
+		VendorName: "oggopus",
+	}, nil
+}
+
+// Serializes the identification header
+// https://tools.ietf.org/html/rfc7845#section-5.1
+func (h OPUSIDHeader) marshal() []byte {
+	data := make([]byte, 19)
+	copy(data, opusHeadPrefix)
+	data[8] = h.Version
+	if data[8] == 0 {
+		data[8] = 1
+	}
+	data[9] = h.ChannelCount
+	binary.LittleEndian.PutUint16(data[10:12], h.PreSkip)
+	binary.LittleEndian.PutUint32(data[12:16], h.InputSampleRate)
+	binary.LittleEndian.PutUint16(data[16:18], h.OutputGain)
+	data[18] = h.ChannelMappingFamily
+	return data
+}
+
+// Serializes the identification header with the channel mapping table of the
+// families other than 0
+func (h OPUSIDHeader) marshalWithMapping() []byte {
+	data := h.marshal()
+	if h.ChannelMappingFamily == MappingFamilyRTP {
+		return data
+	}
+	data = append(data, h.StreamCount, h.CoupledCount)
+	if h.ChannelMappingFamily == MappingFamilyAmbisonicProjection {
+		return append(data, h.DemixingMatrix...)
+	}
+	return append(data, h.ChannelMapping...)
+}
+
+// Serializes the tags header
+// https://tools.ietf.org/html/rfc7845#section-5.2
+func marshalTags(vendor string, comments []string) []byte {
+	data := make([]byte, 0, 16+len(vendor))
+	data = append(data, opusTagsPrefix...)
+	data = appendString(data, vendor)
+	data = appendUint32(data, uint32(len(comments)))
+	for _, comment := range comments {
+		data = appendString(data, comment)
+	}
+	return data
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return append(data, b[:]...)
+}
+
+func appendString(data []byte, s string) []byte {
+	data = appendUint32(data, uint32(len(s)))
+	return append(data, s...)
+}
+
+// Writes the headers, each on its own page, before the first audio packet
+func (w *OPUSWriter) writeHeaders() error {
+	if w.headersWritten {
+		return nil
+	}
+	w.headersWritten = true
+
+	for _, header := range [][]byte{w.header.marshal(), marshalTags(w.VendorName, w.Comments)} {
+		if err := w.OGGWriter.WritePacket(header, 0); err != nil {
+			return err
+		}
+		if err := w.OGGWriter.FlushPage(false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePacket buffers an audio packet until the next FlushPage or Close
+// call. Its granule position is derived from the samples of the packets
+// written so far, starting at 0.
+func (w *OPUSWriter) WritePacket(data []byte) error {
+	if err := w.writeHeaders(); err != nil {
+		return err
+	}
+	w.granule += int64(getPacketSamples(data))
+	return w.OGGWriter.WritePacket(data, w.granule)
+}
+
+// WritePacketWithGranule writes the buffered packets and then the packet on
+// its own page with the given granule position, which is also the base for
+// the following derived positions. If last is set the page ends the stream.
+func (w *OPUSWriter) WritePacketWithGranule(data []byte, granule int64, last bool) error {
+	if err := w.FlushPage(); err != nil {
+		return err
+	}
+	w.granule = granule
+	if err := w.OGGWriter.WritePacket(data, granule); err != nil {
+		return err
+	}
+	return w.OGGWriter.FlushPage(last)
+}
+
+// FlushPage writes the buffered packets
+func (w *OPUSWriter) FlushPage() error {
+	if err := w.writeHeaders(); err != nil {
+		return err
+	}
+	return w.OGGWriter.FlushPage(false)
+}
+
+// Close writes the buffered packets on the last page of the stream
+func (w *OPUSWriter) Close() error {
+	if err := w.writeHeaders(); err != nil {
+		return err
+	}
+	return w.OGGWriter.FlushPage(true)
+}
@@ -0,0 +1,117 @@
+package opusreader
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Length prefix framing of the packets of a raw opus stream
+type PacketFraming int
+
+const (
+	// 2 bytes big-endian length
+	FramingUint16 PacketFraming = iota
+	// 4 bytes big-endian length, as written by ReadChunk
+	FramingUint32
+	// Unsigned varint length, as encoded by binary.PutUvarint
+	FramingUvarint
+)
+
+// Largest packet accepted from a raw stream, so a corrupt length doesn't make
+// the reader allocate an arbitrary amount of memory
+const maxFramedPacketSize = 1 << 20
+
+// NewRawOpusReader returns a OPUSReader of a stream of bare audio packets,
+// each prefixed with its length in the given framing, without Ogg pages. The
+// identification header is known from elsewhere, as for
+// NewOpusReaderWithHeader. The packets have no granule position, so it's -1
+// unless derived at the end, and each packet is counted as its own page.
+func NewRawOpusReader(in io.Reader, head OPUSIDHeader, framing PacketFraming) (*OPUSReader, error) {
+	switch framing {
+	case FramingUint16, FramingUint32, FramingUvarint:
+	default:
+		return nil, errors.New("opusreader: unknown packet framing")
+	}
+	reader, err := NewOpusReaderWithHeader(in, head)
+	if err != nil {
+		return nil, err
+	}
+	reader.OGGReader.framing = &framing
+	return reader, nil
+}
+
+// fetchFramedPacket reads the next length prefixed packet of a raw stream and
+// returns it as a page holding only that packet
+func (o *OGGReader) fetchFramedPacket() (*OGGPage, error) {
+	prefix, length, err := o.readPacketLength()
+	if err != nil {
+		return nil, err
+	}
+	if length > maxFramedPacketSize {
+		return nil, errors.New("opusreader: framed packet too large")
+	}
+	var data []byte
+	if length > 0 {
+		data, err = o.read(int(length))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	page := &OGGPage{
+		OGGPageHeader: OGGPageHeader{
+			CapturePattern:          capturePattern,
+			AbsoluteGranulePosition: -1,
+			SequenceNumber:          o.framedPackets,
+		},
+		packets:      [][]byte{data, nil},
+		packetsCount: 1,
+		packetSizes:  []int{len(data)},
+		totalSize:    len(data),
+		rawHeader:    prefix,
+		body:         data,
+	}
+	o.framedPackets++
+	return page, nil
+}
+
+// readPacketLength reads the length prefix of a packet and returns its raw
+// bytes and value. It returns io.EOF only if the stream ends before the
+// prefix.
+func (o *OGGReader) readPacketLength() ([]byte, uint64, error) {
+	switch *o.framing {
+	case FramingUint16:
+		prefix, err := o.read(2)
+		if err != nil {
+			return nil, 0, err
+		}
+		return prefix, uint64(binary.BigEndian.Uint16(prefix)), nil
+	case FramingUint32:
+		prefix, err := o.read(4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return prefix, uint64(binary.BigEndian.Uint32(prefix)), nil
+	}
+
+	var prefix []byte
+	for len(prefix) < binary.MaxVarintLen64 {
+		b, err := o.read(1)
+		if err == io.EOF && len(prefix) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		prefix = append(prefix, b[0])
+		if b[0] < 0x80 {
+			length, _ := binary.Uvarint(prefix)
+			return prefix, length, nil
+		}
+	}
+	return nil, 0, errors.New("opusreader: invalid packet length")
+}
@@ -0,0 +1,84 @@
+package opusreader
+
+import "io"
+
+// readOrderedPage returns the next page read by readRawPage, reordered by
+// sequence number within each logical stream if ReorderWindow is set. Up to
+// ReorderWindow pages are buffered waiting for the page expected next. When
+// the buffer is full or the stream ends, the buffered page with the lowest
+// sequence number is returned and the missing pages before it are treated as
+// lost. Pages arriving after a later page of their stream was returned are
+// dropped and counted in LatePages.
+func (o *OGGReader) readOrderedPage() (*OGGPage, error) {
+	if o.ReorderWindow <= 0 {
+		return o.readRawPage()
+	}
+	if o.nextSequence == nil {
+		o.nextSequence = make(map[uint32]uint32)
+	}
+
+	ended := false
+	for {
+		if i := o.expectedPage(); i >= 0 {
+			return o.takeReordered(i), nil
+		}
+		if len(o.reorder) > o.ReorderWindow || ended && len(o.reorder) > 0 {
+			return o.takeReordered(o.lowestReordered()), nil
+		}
+		if ended {
+			return nil, io.EOF
+		}
+
+		page, err := o.readRawPage()
+		if err == io.EOF {
+			ended = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		serial := page.BitStreamSerialNumber
+		if page.isFirst() {
+			if _, ok := o.nextSequence[serial]; !ok {
+				o.nextSequence[serial] = page.SequenceNumber
+			}
+		}
+		if next, ok := o.nextSequence[serial]; ok && page.SequenceNumber < next {
+			o.LatePages++
+			continue
+		}
+		o.reorder = append(o.reorder, page)
+	}
+}
+
+// expectedPage returns the index of a buffered page which is the next one of
+// its logical stream, or -1 if there is none
+func (o *OGGReader) expectedPage() int {
+	for i, page := range o.reorder {
+		if next, ok := o.nextSequence[page.BitStreamSerialNumber]; ok && page.SequenceNumber == next {
+			return i
+		}
+	}
+	return -1
+}
+
+// lowestReordered returns the index of the buffered page with the lowest
+// sequence number among the pages of the stream of the oldest buffered page
+func (o *OGGReader) lowestReordered() int {
+	serial := o.reorder[0].BitStreamSerialNumber
+	lowest := 0
+	for i, page := range o.reorder {
+		if page.BitStreamSerialNumber == serial && page.SequenceNumber < o.reorder[lowest].SequenceNumber {
+			lowest = i
+		}
+	}
+	return lowest
+}
+
+// takeReordered removes the buffered page at index i and returns it
+func (o *OGGReader) takeReordered(i int) *OGGPage {
+	page := o.reorder[i]
+	o.reorder = append(o.reorder[:i], o.reorder[i+1:]...)
+	o.nextSequence[page.BitStreamSerialNumber] = page.SequenceNumber + 1
+	return page
+}
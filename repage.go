@@ -0,0 +1,54 @@
+package opusreader
+
+import (
+	"time"
+)
+
+// RepageByDuration copies the opus stream read by r to w, putting about
+// pageDuration of audio on each page. The headers are written on their own
+// pages and the granule positions of the source are preserved.
+func RepageByDuration(r *OPUSReader, w *OGGWriter, pageDuration time.Duration) error {
+	if err := r.ensureHeaders(); err != nil {
+		return err
+	}
+	if err := writeHeaders(r, w); err != nil {
+		return err
+	}
+
+	pageSamples := durationToSamples(pageDuration)
+	var samples, granule int64
+	err := r.eachPacket(func(packet *OPUSPacket) error {
+		granule += int64(getPacketSamples(packet.PacketData))
+		if packet.GranulePosition != -1 {
+			granule = packet.GranulePosition
+		}
+		if err := w.WritePacket(packet.PacketData, granule); err != nil {
+			return err
+		}
+
+		samples += int64(getPacketSamples(packet.PacketData))
+		if samples >= pageSamples && !r.LastPacket {
+			samples = 0
+			return w.FlushPage(false)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.FlushPage(true)
+}
+
+// Writes the identification and the tags headers of r, each on its own page
+func writeHeaders(r *OPUSReader, w *OGGWriter) error {
+	for _, header := range [][]byte{r.RawIDHeader, r.RawTags} {
+		if err := w.WritePacket(header, 0); err != nil {
+			return err
+		}
+		if err := w.FlushPage(false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
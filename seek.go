@@ -0,0 +1,475 @@
+package opusreader
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Initial size of the window at the end of the stream searched for pages.
+// It's doubled until enough pages are found.
+const seekWindow = 64 * 1024
+
+// Position of a page with a known granule position
+type pagePosition struct {
+	offset  int64
+	next    int64
+	granule int64
+}
+
+func (o *OPUSReader) ensureHeaders() error {
+	if o.initialized {
+		return nil
+	}
+	if err := o.readHeaders(); err != nil {
+		return &HeaderError{Err: err}
+	}
+	return nil
+}
+
+func (o *OPUSReader) streamSize() (int64, error) {
+	if o.OGGReader.parent != nil {
+		return 0, errors.New("opusreader: a track can't seek the shared stream")
+	}
+	seeker, ok := o.OGGReader.stream.(io.Seeker)
+	if !ok {
+		return 0, errors.New("opusreader: stream is not seekable")
+	}
+	return seeker.Seek(0, io.SeekEnd)
+}
+
+// Progress returns the fraction of the stream read so far, i.e. the bytes of
+// the pages read completely divided by the size of the stream, for
+// a progress bar. It advances page by page. The size is determined at the
+// first call, without moving the reading position. It's 0 if the stream
+// isn't seekable.
+func (o *OPUSReader) Progress() float64 {
+	if o.streamLength == 0 {
+		seeker, ok := o.OGGReader.stream.(io.Seeker)
+		if !ok {
+			return 0
+		}
+		current, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0
+		}
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if _, serr := seeker.Seek(current, io.SeekStart); err != nil || serr != nil || size == 0 {
+			return 0
+		}
+		o.streamLength = size
+	}
+	return math.Min(float64(o.OGGReader.BytesRead())/float64(o.streamLength), 1)
+}
+
+// Returns positions of all the audio pages with a granule position
+// starting from the first page at or after offset
+func (o *OPUSReader) pagesFrom(offset int64) ([]pagePosition, error) {
+	var pages []pagePosition
+	err := o.OGGReader.scanPages(offset, func(offset int64, page *OGGPage) bool {
+		if page.AbsoluteGranulePosition != -1 {
+			pages = append(pages, pagePosition{
+				offset:  offset,
+				next:    offset + int64(page.size()),
+				granule: page.AbsoluteGranulePosition,
+			})
+		}
+		return true
+	})
+	return pages, err
+}
+
+// Moves the reader to the first page at or after offset. The granule is the
+// position reached before that page, it's used to restore the pre-skip
+// and the duration state.
+func (o *OPUSReader) resetAt(offset, granule int64) error {
+	_, err := o.OGGReader.seekPage(offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	o.OGGReader.lastPagePosition = granule
+
+	skipped := granule
+	if skipped > int64(o.PreSkip) {
+		skipped = int64(o.PreSkip)
+	}
+	o.skipped = int(skipped)
+	o.Duration = int((granule - skipped) * 1000000 / 48000)
+	o.samples = granule - skipped
+	o.LastPacket = false
+	o.inputEnded = false
+	o.pending = nil
+	o.pendingLast = false
+
+	return nil
+}
+
+// Returns the granule position of the last page of the stream
+func (o *OPUSReader) lastGranule() (int64, error) {
+	end, err := o.streamSize()
+	if err != nil {
+		return 0, err
+	}
+	for window := int64(seekWindow); ; window *= 2 {
+		from := end - window
+		if from < o.audioOffset {
+			from = o.audioOffset
+		}
+		pages, err := o.pagesFrom(from)
+		if err != nil {
+			return 0, err
+		}
+		if len(pages) > 0 {
+			return pages[len(pages)-1].granule, nil
+		}
+		if from == o.audioOffset {
+			return 0, errors.New("opusreader: no granule position found")
+		}
+	}
+}
+
+// Moves the reader to the page following the last page which ends at or
+// before the target granule position
+func (o *OPUSReader) seekGranule(target int64) error {
+	end, err := o.streamSize()
+	if err != nil {
+		return err
+	}
+	for window := int64(seekWindow); ; window *= 2 {
+		from := end - window
+		if from < o.audioOffset {
+			from = o.audioOffset
+		}
+		pages, err := o.pagesFrom(from)
+		if err != nil {
+			return err
+		}
+		for i := len(pages) - 1; i >= 0; i-- {
+			if pages[i].granule <= target {
+				return o.resetAt(pages[i].next, pages[i].granule)
+			}
+		}
+		if from == o.audioOffset {
+			return o.resetAt(o.audioOffset, 0)
+		}
+	}
+}
+
+func samplesToDuration(samples int64) time.Duration {
+	return time.Duration(samples) * time.Second / 48000
+}
+
+func durationToSamples(d time.Duration) int64 {
+	return int64(d / time.Microsecond * 48000 / 1000000)
+}
+
+// TotalDuration returns the duration of the whole stream, computed from the
+// granule position of the last page. The stream has to be seekable, the
+// current reading position is preserved.
+func (o *OPUSReader) TotalDuration() (time.Duration, error) {
+	samples, err := o.QuickSampleCount()
+	if err != nil {
+		return 0, err
+	}
+	return samplesToDuration(samples), nil
+}
+
+// QuickSampleCount returns the number of output samples of the whole stream,
+// i.e. the granule position of the last page minus the pre-skip, e.g. to size
+// a buffer for the decoded audio. Only the headers and the pages near the end
+// of the stream are read. The stream has to be seekable, the current reading
+// position is preserved.
+func (o *OPUSReader) QuickSampleCount() (int64, error) {
+	if err := o.ensureHeaders(); err != nil {
+		return 0, err
+	}
+	if _, err := o.streamSize(); err != nil {
+		return 0, err
+	}
+	restore := o.OGGReader.keepPosition()
+	granule, err := o.lastGranule()
+	if rerr := restore(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	samples := granule - int64(o.PreSkip)
+	if samples < 0 {
+		samples = 0
+	}
+	return samples, nil
+}
+
+// StreamDurations returns the duration of each logical opus stream of the
+// physical stream in the order they begin, i.e. the segments of a chained
+// stream one after the other and the multiplexed streams in the order of
+// their first pages. Each is computed from the granule position of the last
+// page of the stream and its pre-skip, like TotalDuration. Logical streams
+// of other codecs are left out. The stream has to be seekable, the current
+// reading position is preserved.
+func (o *OPUSReader) StreamDurations() ([]time.Duration, error) {
+	if _, err := o.streamSize(); err != nil {
+		return nil, err
+	}
+	restore := o.OGGReader.keepPosition()
+	durations, err := o.streamDurations()
+	if rerr := restore(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return durations, nil
+}
+
+func (o *OPUSReader) streamDurations() ([]time.Duration, error) {
+	type logicalStream struct {
+		offset  int64
+		granule int64
+	}
+	var streams []*logicalStream
+	current := make(map[uint32]*logicalStream)
+	err := o.OGGReader.scanPages(0, func(offset int64, page *OGGPage) bool {
+		serial := page.BitStreamSerialNumber
+		if page.isFirst() {
+			current[serial] = &logicalStream{offset: offset}
+			streams = append(streams, current[serial])
+		}
+		if stream := current[serial]; stream != nil && page.AbsoluteGranulePosition != -1 {
+			stream.granule = page.AbsoluteGranulePosition
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var durations []time.Duration
+	for _, stream := range streams {
+		head, err := o.OGGReader.firstPacketAt(stream.offset)
+		if err != nil {
+			return nil, err
+		}
+		header, err := ParseOpusHead(head)
+		if err != nil {
+			// not an opus stream
+			continue
+		}
+		samples := stream.granule - int64(header.PreSkip)
+		if samples < 0 {
+			samples = 0
+		}
+		durations = append(durations, samplesToDuration(samples))
+	}
+	return durations, nil
+}
+
+// RemainingDuration returns the duration of the audio following the current
+// position, i.e. TotalDuration minus Position, both without the pre-skip.
+// The stream has to be seekable.
+func (o *OPUSReader) RemainingDuration() (time.Duration, error) {
+	total, err := o.TotalDuration()
+	if err != nil {
+		return 0, err
+	}
+	// the position of the last packet isn't end-trimmed
+	remaining := total - samplesToDuration(o.Position())
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, nil
+}
+
+// SeekEnd positions the reader d before the end of the stream, so the
+// following NextPacket calls return the last part of the audio. Reading
+// resumes at a page boundary at or before the requested position.
+func (o *OPUSReader) SeekEnd(d time.Duration) error {
+	if err := o.ensureHeaders(); err != nil {
+		return err
+	}
+	granule, err := o.lastGranule()
+	if err != nil {
+		return err
+	}
+
+	target := granule - durationToSamples(d)
+	if target < 0 {
+		target = 0
+	}
+	return o.seekGranule(target)
+}
+
+// TailPackets returns the last n audio packets of the stream without reading
+// it from the beginning. The reader is left at the end of the stream, unless
+// n is 0.
+func (o *OPUSReader) TailPackets(n int) ([]*OPUSPacket, error) {
+	if n < 0 {
+		return nil, errors.New("opusreader: negative number of packets")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if err := o.ensureHeaders(); err != nil {
+		return nil, err
+	}
+	end, err := o.streamSize()
+	if err != nil {
+		return nil, err
+	}
+
+	for window := int64(seekWindow); ; window *= 2 {
+		from := end - window
+		if from < o.audioOffset {
+			from = o.audioOffset
+		}
+
+		if from == o.audioOffset {
+			err = o.resetAt(o.audioOffset, 0)
+		} else {
+			var pages []pagePosition
+			pages, err = o.pagesFrom(from)
+			if err != nil {
+				return nil, err
+			}
+			if len(pages) == 0 {
+				continue
+			}
+			err = o.resetAt(pages[0].next, pages[0].granule)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var packets []*OPUSPacket
+		for !o.LastPacket {
+			packet, err := o.NextPacket()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, packet)
+		}
+
+		if len(packets) >= n || from == o.audioOffset {
+			if len(packets) > n {
+				packets = packets[len(packets)-n:]
+			}
+			return packets, nil
+		}
+	}
+}
+
+// FirstAudioGranule returns the granule position of the first audio page
+// which completes a packet. Per RFC 7845 it may not be smaller than the
+// number of samples of the packets completed on that page, and the
+// difference between the two is the number of samples to skip on top of the
+// ones of the packets themselves, which has to cover at least PreSkip. It's
+// known once the first audio packet was read; before that the stream has to
+// be seekable and the reading position is preserved.
+func (o *OPUSReader) FirstAudioGranule() (int64, error) {
+	if o.hasFirstGranule {
+		return o.firstGranule, nil
+	}
+	if err := o.ensureHeaders(); err != nil {
+		return 0, err
+	}
+	if _, err := o.streamSize(); err != nil {
+		return 0, err
+	}
+
+	restore := o.OGGReader.keepPosition()
+	granule := int64(-1)
+	err := o.OGGReader.scanPages(o.audioOffset, func(offset int64, page *OGGPage) bool {
+		granule = page.AbsoluteGranulePosition
+		return granule == -1
+	})
+	if rerr := restore(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if granule == -1 {
+		return 0, errors.New("opusreader: no granule position found")
+	}
+	return granule, nil
+}
+
+// GranuleMonotonic scans the page headers of the whole stream and reports
+// whether the granule position never decreases from a page to the next one
+// of the same logical stream. Pages with no granule position are ignored,
+// and each logical stream of a chained stream is checked on its own. The
+// stream has to be seekable, the current reading position is preserved.
+func (o *OPUSReader) GranuleMonotonic() (bool, error) {
+	if _, err := o.streamSize(); err != nil {
+		return false, err
+	}
+
+	restore := o.OGGReader.keepPosition()
+	monotonic := true
+	previous := make(map[uint32]int64)
+	err := o.OGGReader.scanPages(0, func(offset int64, page *OGGPage) bool {
+		serial := page.BitStreamSerialNumber
+		if page.isFirst() {
+			delete(previous, serial)
+		}
+		granule := page.AbsoluteGranulePosition
+		if granule == -1 {
+			return true
+		}
+		if last, ok := previous[serial]; ok && granule < last {
+			monotonic = false
+			return false
+		}
+		previous[serial] = granule
+		return true
+	})
+	if rerr := restore(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return false, err
+	}
+	return monotonic, nil
+}
+
+// TimeAtOffset returns the time of the audio at a byte offset of the stream,
+// e.g. to translate an HTTP range to a playback position. It's the end time
+// of the first page at or after the offset which completes a packet,
+// without the pre-skip. The stream has to be seekable, the current reading
+// position is preserved.
+func (o *OPUSReader) TimeAtOffset(offset int64) (time.Duration, error) {
+	if err := o.ensureHeaders(); err != nil {
+		return 0, err
+	}
+	if _, err := o.streamSize(); err != nil {
+		return 0, err
+	}
+
+	restore := o.OGGReader.keepPosition()
+	granule := int64(-1)
+	err := o.OGGReader.scanPages(offset, func(offset int64, page *OGGPage) bool {
+		granule = page.AbsoluteGranulePosition
+		return granule == -1
+	})
+	if rerr := restore(); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if granule == -1 {
+		return 0, errors.New("opusreader: no granule position found")
+	}
+
+	samples := granule - int64(o.PreSkip)
+	if samples < 0 {
+		samples = 0
+	}
+	return samplesToDuration(samples), nil
+}
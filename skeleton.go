@@ -0,0 +1,139 @@
+package opusreader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	skeletonHeadPrefix = "fishead\x00"
+	skeletonBonePrefix = "fisbone\x00"
+)
+
+// Contains fields of the Ogg Skeleton fishead packet, which describes the
+// timing of the whole physical stream
+// https://wiki.xiph.org/SkeletonHeaders
+type SkeletonHead struct {
+	VersionMajor uint16
+	VersionMinor uint16
+
+	PresentationTimeNumerator   int64
+	PresentationTimeDenominator int64
+	BaseTimeNumerator           int64
+	BaseTimeDenominator         int64
+	UTC                         [20]byte
+}
+
+// Contains fields of the Ogg Skeleton fisbone packet, which describes one
+// of the logical streams
+type SkeletonBone struct {
+	Serial        uint32
+	HeaderPackets uint32
+
+	GranuleRateNumerator   int64
+	GranuleRateDenominator int64
+	BaseGranule            int64
+	Preroll                uint32
+	GranuleShift           uint8
+
+	// Message header fields, e.g. "Content-Type", by name
+	Headers map[string]string
+}
+
+// PresentationTime returns the time at which the presentation starts
+func (h *SkeletonHead) PresentationTime() time.Duration {
+	return rationalDuration(h.PresentationTimeNumerator, h.PresentationTimeDenominator)
+}
+
+// BaseTime returns the time corresponding to the granule position 0
+func (h *SkeletonHead) BaseTime() time.Duration {
+	return rationalDuration(h.BaseTimeNumerator, h.BaseTimeDenominator)
+}
+
+func rationalDuration(numerator, denominator int64) time.Duration {
+	if denominator == 0 {
+		return 0
+	}
+	return time.Duration(float64(numerator) / float64(denominator) * float64(time.Second))
+}
+
+// readSkeletonPage parses the page if it belongs to a skeleton stream and
+// reports whether it did. Only the packets completed on the page are parsed.
+func (o *OGGReader) readSkeletonPage(page *OGGPage) (bool, error) {
+	if page.isFirst() {
+		if page.packetsCount == 0 || !bytes.HasPrefix(page.packets[0], []byte(skeletonHeadPrefix)) {
+			return false, nil
+		}
+		head, err := parseSkeletonHead(page.packets[0])
+		if err != nil {
+			return false, err
+		}
+		o.Skeleton = head
+		o.skeletonSerial = page.BitStreamSerialNumber
+		return true, nil
+	}
+
+	if o.Skeleton == nil || page.BitStreamSerialNumber != o.skeletonSerial {
+		return false, nil
+	}
+	for _, packet := range page.packets[:page.packetsCount] {
+		if !bytes.HasPrefix(packet, []byte(skeletonBonePrefix)) {
+			continue
+		}
+		bone, err := parseSkeletonBone(packet)
+		if err != nil {
+			return false, err
+		}
+		o.SkeletonBones = append(o.SkeletonBones, bone)
+	}
+	return true, nil
+}
+
+func parseSkeletonHead(data []byte) (*SkeletonHead, error) {
+	if len(data) < 64 {
+		return nil, errors.New("ogg: truncated skeleton head")
+	}
+	head := &SkeletonHead{
+		VersionMajor:                binary.LittleEndian.Uint16(data[8:10]),
+		VersionMinor:                binary.LittleEndian.Uint16(data[10:12]),
+		PresentationTimeNumerator:   int64(binary.LittleEndian.Uint64(data[12:20])),
+		PresentationTimeDenominator: int64(binary.LittleEndian.Uint64(data[20:28])),
+		BaseTimeNumerator:           int64(binary.LittleEndian.Uint64(data[28:36])),
+		BaseTimeDenominator:         int64(binary.LittleEndian.Uint64(data[36:44])),
+	}
+	copy(head.UTC[:], data[44:64])
+	return head, nil
+}
+
+func parseSkeletonBone(data []byte) (SkeletonBone, error) {
+	if len(data) < 52 {
+		return SkeletonBone{}, errors.New("ogg: truncated skeleton bone")
+	}
+	bone := SkeletonBone{
+		Serial:                 binary.LittleEndian.Uint32(data[12:16]),
+		HeaderPackets:          binary.LittleEndian.Uint32(data[16:20]),
+		GranuleRateNumerator:   int64(binary.LittleEndian.Uint64(data[20:28])),
+		GranuleRateDenominator: int64(binary.LittleEndian.Uint64(data[28:36])),
+		BaseGranule:            int64(binary.LittleEndian.Uint64(data[36:44])),
+		Preroll:                binary.LittleEndian.Uint32(data[44:48]),
+		GranuleShift:           data[48],
+		Headers:                make(map[string]string),
+	}
+
+	// the offset of the message headers is relative to its own field
+	offset := 8 + uint64(binary.LittleEndian.Uint32(data[8:12]))
+	if offset > uint64(len(data)) {
+		return SkeletonBone{}, errors.New("ogg: invalid skeleton bone headers offset")
+	}
+	for _, line := range strings.Split(string(data[offset:]), "\r\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		bone.Headers[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return bone, nil
+}
@@ -0,0 +1,72 @@
+package opusreader
+
+import (
+	"io"
+	"time"
+)
+
+// Audio put on each page by the functions copying a stream
+const copyPageDuration = time.Second
+
+// SplitByDuration copies the opus stream read by r into consecutive
+// independent streams of about segment of audio each, cut at packet
+// boundaries. The writer of each segment is returned by next, with the index
+// of the segment starting at 0. Each segment starts with the headers of the
+// source stream and granule positions starting at 0, so the PreSkip of the
+// header is trimmed at the beginning of every segment, which lets the
+// decoder converge after starting mid-stream. The end trimming of the last
+// page of the source isn't preserved.
+func SplitByDuration(r *OPUSReader, segment time.Duration, next func(index int) (io.Writer, error)) error {
+	if err := r.ensureHeaders(); err != nil {
+		return err
+	}
+
+	segmentSamples := durationToSamples(segment)
+	pageSamples := durationToSamples(copyPageDuration)
+	var w *OGGWriter
+	var index int
+	var granule, pageGranule int64
+	err := r.eachPacket(func(packet *OPUSPacket) error {
+		if w != nil && granule >= segmentSamples {
+			if err := w.FlushPage(true); err != nil {
+				return err
+			}
+			w = nil
+		}
+		if w == nil {
+			out, err := next(index)
+			if err != nil {
+				return err
+			}
+			// the page of the first packet, there may be no header page
+			serial := r.OGGReader.CurrentPage.BitStreamSerialNumber
+			if w, err = NewOggWriter(out, serial); err != nil {
+				return err
+			}
+			if err := writeHeaders(r, w); err != nil {
+				return err
+			}
+			index++
+			granule, pageGranule = 0, 0
+		}
+
+		granule += int64(getPacketSamples(packet.PacketData))
+		if err := w.WritePacket(packet.PacketData, granule); err != nil {
+			return err
+		}
+		// the last page of a segment is written with the end of stream flag
+		if granule-pageGranule >= pageSamples && granule < segmentSamples && !r.LastPacket {
+			pageGranule = granule
+			return w.FlushPage(false)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if w == nil {
+		return nil
+	}
+	return w.FlushPage(true)
+}
@@ -0,0 +1,151 @@
+package opusreader
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// Packets of at most this size carry no audible content, it's what encoders
+// emit for silence in DTX mode
+const silencePacketSize = 2
+
+// Reference level of the R128 gain tags in LUFS
+const r128Reference = -23
+
+// Bitrate mapped to the reference level by the loudness estimate of streams
+// without R128 tags, and the level returned for streams without audio
+const (
+	loudnessReferenceBitrate = 64000
+	loudnessFloor            = -70
+)
+
+// eachPacket calls fn for each remaining audio packet of the stream
+func (o *OPUSReader) eachPacket(fn func(packet *OPUSPacket) error) error {
+	for !o.LastPacket {
+		packet, err := o.NextPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SilenceRatio reads the rest of the stream and returns the fraction of the
+// samples carried by empty or DTX sized packets. It's a cheap estimate of
+// the amount of silence which doesn't require decoding.
+func (o *OPUSReader) SilenceRatio() (float64, error) {
+	var silent, total int
+	err := o.eachPacket(func(packet *OPUSPacket) error {
+		total += packet.TotalSamples
+		if len(packet.PacketData) <= silencePacketSize {
+			silent += packet.TotalSamples
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(silent) / float64(total), nil
+}
+
+// TotalAudioBytes returns the payload size of the audio packets read so far,
+// without the headers and the Ogg framing
+func (o *OPUSReader) TotalAudioBytes() int64 {
+	return o.audioBytes
+}
+
+// AverageBitrate returns the bitrate of the audio payload read so far in bits
+// per second, i.e. TotalAudioBytes*8*48000 divided by the number of output
+// samples. It's 0 until samples past the pre-skip were read.
+func (o *OPUSReader) AverageBitrate() int {
+	if o.samples <= 0 {
+		return 0
+	}
+	return int(o.audioBytes * 8 * 48000 / o.samples)
+}
+
+// MaxPacketDuration returns the duration of the longest audio packet read so
+// far, including the samples trimmed as pre-skip, i.e. the worst case
+// a jitter buffer has to hold
+func (o *OPUSReader) MaxPacketDuration() time.Duration {
+	return samplesToDuration(int64(o.longestPacket))
+}
+
+// ContainerBitrate returns the bitrate of the whole file in bits per second,
+// i.e. its size including the headers and the Ogg framing divided by the
+// duration of the stream, unlike AverageBitrate which counts only the audio
+// payload. The stream has to be seekable, the reading position is preserved.
+func (o *OPUSReader) ContainerBitrate() (int, error) {
+	if err := o.ensureHeaders(); err != nil {
+		return 0, err
+	}
+	size, err := o.streamSize()
+	if err != nil {
+		return 0, err
+	}
+	// the reading position is restored after finding the last granule
+	samples, err := o.QuickSampleCount()
+	if err != nil {
+		return 0, err
+	}
+	if samples == 0 {
+		return 0, errors.New("opusreader: stream has no audio")
+	}
+	return int(size * 8 * 48000 / samples), nil
+}
+
+// EstimatedLoudness returns the loudness of the decoded output in LUFS. If the
+// stream has a valid R128_TRACK_GAIN tag, the loudness is derived from it and
+// ok is true. Otherwise a coarse estimate is computed from the average
+// bitrate of the packets read so far, which is only meaningful to compare
+// streams produced by the same encoder settings, and ok is false. The headers
+// are read first if no packet was read yet.
+// https://tools.ietf.org/html/rfc7845#section-5.2.1
+func (o *OPUSReader) EstimatedLoudness() (lufs float64, ok bool) {
+	if err := o.ensureHeaders(); err == nil {
+		if gain, ok := o.trackGain(); ok {
+			return r128Reference - gain, true
+		}
+	}
+
+	bitrate := o.AverageBitrate()
+	if bitrate <= 0 {
+		return loudnessFloor, false
+	}
+	return math.Max(r128Reference+10*math.Log10(float64(bitrate)/loudnessReferenceBitrate), loudnessFloor), false
+}
+
+// HasConstantConfig reads the rest of the stream and reports whether all the
+// audio packets have the same config code, i.e. the same mode, bandwidth and
+// frame size, and returns that config code. It's false for a stream without
+// audio packets.
+func (o *OPUSReader) HasConstantConfig() (constant bool, config uint8, err error) {
+	count := 0
+	constant = true
+	err = o.eachPacket(func(packet *OPUSPacket) error {
+		if count > 0 && packet.ConfigCode != config {
+			constant = false
+		}
+		config = packet.ConfigCode
+		count++
+		return nil
+	})
+	if err != nil || count == 0 {
+		return false, 0, err
+	}
+	if !constant {
+		return false, 0, nil
+	}
+	return true, config, nil
+}
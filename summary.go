@@ -0,0 +1,130 @@
+package opusreader
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StreamSummary describes a stream in a form suitable for machine-readable
+// output. Fields may be added in the future, but existing fields and their
+// JSON names are not changed.
+type StreamSummary struct {
+	Channels        int     `json:"channels"`
+	SampleRate      int     `json:"sample_rate"`
+	InputSampleRate uint32  `json:"input_sample_rate"`
+	PreSkip         uint16  `json:"pre_skip"`
+	OutputGainDB    float64 `json:"output_gain_db"`
+	MappingFamily   uint8   `json:"mapping_family"`
+
+	Vendor string `json:"vendor"`
+	// Comment values by upper-cased field name
+	Comments map[string][]string `json:"comments"`
+
+	// Duration of the audio read, without the pre-skip
+	DurationSeconds float64 `json:"duration_seconds"`
+	Packets         int     `json:"packets"`
+	AudioBytes      int64   `json:"audio_bytes"`
+
+	// Bitrates of the audio payload in bits per second. The minimum and the
+	// maximum are the bitrates of single packets.
+	AverageBitrate int `json:"average_bitrate"`
+	MinBitrate     int `json:"min_bitrate"`
+	MaxBitrate     int `json:"max_bitrate"`
+}
+
+// Summary describes the stream read so far. Read the stream to the end
+// to get the duration and the statistics of the whole stream.
+func (o *OPUSReader) Summary() StreamSummary {
+	decodeRate, inputRate := o.Rates()
+	summary := StreamSummary{
+		Channels:        int(o.ChannelCount),
+		SampleRate:      decodeRate,
+		InputSampleRate: inputRate,
+		PreSkip:         o.PreSkip,
+		OutputGainDB:    float64(int16(o.OutputGain)) / 256,
+		MappingFamily:   o.ChannelMappingFamily,
+		Vendor:          o.VendorString(),
+		Comments:        commentsMap(o.Comments),
+		DurationSeconds: float64(o.samples) / float64(decodeRate),
+		Packets:         o.packetCount,
+		AudioBytes:      o.audioBytes,
+		AverageBitrate:  o.AverageBitrate(),
+		MinBitrate:      o.minBitrate,
+		MaxBitrate:      o.maxBitrate,
+	}
+	return summary
+}
+
+// Groups "NAME=value" comments by the upper-cased name
+func commentsMap(comments []string) map[string][]string {
+	m := make(map[string][]string)
+	for _, comment := range comments {
+		i := strings.IndexByte(comment, '=')
+		if i < 0 {
+			continue
+		}
+		name := strings.ToUpper(comment[:i])
+		m[name] = append(m[name], comment[i+1:])
+	}
+	return m
+}
+
+// EncoderOptions parses the ENCODER_OPTIONS comments written by opusenc, which
+// hold the command line options of the encoder, e.g. "--bitrate 96 --comp
+// 10", into the option names without the dashes and their values. Options
+// without a value, like "--vbr", map to an empty string. It returns false if
+// the stream has no such comment.
+func (o *OPUSReader) EncoderOptions() (map[string]string, bool) {
+	comments := commentsMap(o.Comments)["ENCODER_OPTIONS"]
+	if len(comments) == 0 {
+		return nil, false
+	}
+
+	options := make(map[string]string)
+	for _, comment := range comments {
+		name := ""
+		for _, field := range strings.Fields(comment) {
+			// negative numbers are values, not options
+			if _, err := strconv.ParseFloat(field, 64); err == nil || !strings.HasPrefix(field, "-") {
+				if name != "" {
+					options[name] = field
+					name = ""
+				}
+				continue
+			}
+			name = strings.TrimLeft(field, "-")
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				options[name[:i]] = name[i+1:]
+				name = ""
+				continue
+			}
+			options[name] = ""
+		}
+	}
+	return options, true
+}
+
+func (s StreamSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "channels: %d, mapping family: %d\n", s.Channels, s.MappingFamily)
+	fmt.Fprintf(&b, "sample rate: %d Hz (input %d Hz)\n", s.SampleRate, s.InputSampleRate)
+	fmt.Fprintf(&b, "pre-skip: %d, output gain: %.2f dB\n", s.PreSkip, s.OutputGainDB)
+	fmt.Fprintf(&b, "vendor: %s\n", s.Vendor)
+
+	names := make([]string, 0, len(s.Comments))
+	for name := range s.Comments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range s.Comments[name] {
+			fmt.Fprintf(&b, "  %s=%s\n", name, value)
+		}
+	}
+
+	fmt.Fprintf(&b, "duration: %.3f s, packets: %d, audio bytes: %d\n", s.DurationSeconds, s.Packets, s.AudioBytes)
+	fmt.Fprintf(&b, "bitrate: %d bps (min %d, max %d)", s.AverageBitrate, s.MinBitrate, s.MaxBitrate)
+	return b.String()
+}
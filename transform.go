@@ -0,0 +1,36 @@
+package opusreader
+
+// Transform copies the audio packets read by r to w, replacing each packet by
+// the data returned by fn, or dropping it if fn returns nil. The granule
+// positions are derived by w from the samples of the packets written, so
+// they follow the changed durations. The headers are those of w, the fields
+// of r can be used to set them up. The stream written is closed at the end.
+func Transform(r *OPUSReader, w *OPUSWriter, fn func(packet *OPUSPacket) []byte) error {
+	if err := r.ensureHeaders(); err != nil {
+		return err
+	}
+
+	// a page is written only when the next packet is known, so the last
+	// page is never empty
+	pageSamples := durationToSamples(copyPageDuration)
+	var samples int64
+	err := r.eachPacket(func(packet *OPUSPacket) error {
+		data := fn(packet)
+		if data == nil {
+			return nil
+		}
+		if samples >= pageSamples {
+			samples = 0
+			if err := w.FlushPage(); err != nil {
+				return err
+			}
+		}
+		samples += int64(getPacketSamples(data))
+		return w.WritePacket(data)
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
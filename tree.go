@@ -0,0 +1,167 @@
+package opusreader
+
+import (
+	"io"
+	"time"
+)
+
+// StreamTree describes the structure of a physical stream: its logical
+// streams, their pages, the packets ending on each page and the frames of the
+// opus audio packets
+type StreamTree struct {
+	Streams []*StreamNode
+}
+
+// Logical stream of a StreamTree
+type StreamNode struct {
+	Serial uint32
+	// Identification header of an opus stream, nil for other streams
+	Header *OPUSIDHeader
+	Pages  []*PageNode
+}
+
+// Page of a StreamTree
+type PageNode struct {
+	// Offset of the page in the physical stream and its size with the header
+	Offset          int64
+	Size            int
+	SequenceNumber  uint32
+	GranulePosition int64
+	Flags           PageFlags
+	// Packets ending on the page
+	Packets []*PacketNode
+}
+
+// Packet of a StreamTree
+type PacketNode struct {
+	// Offset of the first byte of the packet in the physical stream and the
+	// size of the packet, which spans Pages pages
+	Offset int64
+	Size   int
+	Pages  int
+	// Config of an opus audio packet, nil for the headers and the packets
+	// of other streams
+	Config *OPUSPacketConfig
+	// Frames of an opus audio packet of a single opus stream
+	Frames []FrameNode
+	// Error of an invalid opus audio packet
+	Err error
+}
+
+// Frame of an opus audio packet of a StreamTree
+type FrameNode struct {
+	Size       int
+	Duration   time.Duration
+	ConfigCode uint8
+	Stereo     bool
+}
+
+// Beginning of a packet continued on the following pages
+type partialPacket struct {
+	offset int64
+	data   []byte
+	pages  int
+}
+
+// BuildStreamTree reads the whole stream and returns its structure, e.g. for
+// an inspector. The leading fragment of a packet begun before the start of
+// the input is left out.
+func BuildStreamTree(r io.Reader) (*StreamTree, error) {
+	ogg, err := NewOggReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := new(StreamTree)
+	streams := make(map[uint32]*StreamNode)
+	packets := make(map[uint32]int)
+	partial := make(map[uint32]*partialPacket)
+	for {
+		offset := ogg.BytesRead()
+		page, err := ogg.NextPage()
+		if err == io.EOF {
+			return tree, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		serial := page.BitStreamSerialNumber
+		stream := streams[serial]
+		if stream == nil {
+			stream = &StreamNode{Serial: serial}
+			streams[serial] = stream
+			tree.Streams = append(tree.Streams, stream)
+		}
+		node := &PageNode{
+			Offset:          offset,
+			Size:            page.size(),
+			SequenceNumber:  page.SequenceNumber,
+			GranulePosition: page.AbsoluteGranulePosition,
+			Flags:           page.Flags(),
+		}
+		stream.Pages = append(stream.Pages, node)
+
+		position := offset + int64(27+int(page.SegmentsNumber))
+		for i, data := range page.packets {
+			packet := &partialPacket{offset: position, data: data, pages: 1}
+			position += int64(len(data))
+			if i == 0 && node.Flags.Continued {
+				begun := partial[serial]
+				if begun == nil {
+					continue
+				}
+				packet = &partialPacket{
+					offset: begun.offset,
+					data:   append(begun.data[:len(begun.data):len(begun.data)], data...),
+					pages:  begun.pages + 1,
+				}
+			}
+			if i == page.packetsCount {
+				partial[serial] = nil
+				if len(data) > 0 || page.needsContinue {
+					partial[serial] = packet
+				}
+				break
+			}
+
+			node.Packets = append(node.Packets, stream.packetNode(packet, packets[serial]))
+			packets[serial]++
+		}
+	}
+}
+
+// packetNode describes the index-th packet of the stream, reading the opus
+// identification header from the first one
+func (s *StreamNode) packetNode(packet *partialPacket, index int) *PacketNode {
+	node := &PacketNode{
+		Offset: packet.offset,
+		Size:   len(packet.data),
+		Pages:  packet.pages,
+	}
+	if index == 0 {
+		if header, err := ParseOpusHead(packet.data); err == nil {
+			s.Header = &header
+		}
+	}
+	if s.Header == nil || index < 2 {
+		return node
+	}
+
+	opusPacket := &OPUSPacket{PacketData: packet.data, multistream: s.Header.StreamCount > 1}
+	if node.Err = opusPacket.readPacketConfig(); node.Err != nil {
+		return node
+	}
+	config := opusPacket.OPUSPacketConfig
+	node.Config = &config
+	duration := samplesToDuration(int64(config.SamplesNumberPerFrame))
+	for _, frame := range opusPacket.frames {
+		node.Frames = append(node.Frames, FrameNode{
+			Size:       len(frame),
+			Duration:   duration,
+			ConfigCode: config.ConfigCode,
+			Stereo:     config.SoundMode == 1,
+		})
+	}
+	return node
+}
@@ -0,0 +1,38 @@
+package opusreader
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// WriteWAVHeader writes a canonical 44 bytes header of a 16-bit PCM WAV file
+// at 48000 Hz, the rate opus is decoded at. dataBytes is the size of the PCM
+// data following the header.
+func WriteWAVHeader(w io.Writer, channels int, dataBytes uint32) error {
+	if channels < 1 || channels > 255 {
+		return errors.New("opusreader: invalid channels count")
+	}
+
+	const sampleRate = 48000
+	const bitsPerSample = 16
+	blockAlign := channels * bitsPerSample / 8
+
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], 36+dataBytes)
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], 1) // PCM
+	binary.LittleEndian.PutUint16(header[22:24], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:28], sampleRate)
+	binary.LittleEndian.PutUint32(header[28:32], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(header[32:34], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:36], bitsPerSample)
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], dataBytes)
+
+	_, err := w.Write(header)
+	return err
+}